@@ -1,9 +1,11 @@
 package app
 
 import (
+	"context"
 	"log"
 	"os"
 	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/ensonmj/ghost/cmd/ghost/app/dns"
@@ -12,8 +14,9 @@ import (
 )
 
 var (
-	fDNSConfigPath  string
-	fDNSForceUpdate bool
+	fDNSConfigPath      string
+	fDNSForceUpdate     bool
+	fDNSShutdownTimeout time.Duration
 )
 
 var DNSCmd = &cobra.Command{
@@ -26,6 +29,7 @@ func init() {
 	flags := DNSCmd.Flags()
 	flags.StringVar(&fDNSConfigPath, "config", "dns.toml", "location of the config file, if not found it will be generated (default dns.toml)")
 	flags.BoolVar(&fDNSForceUpdate, "update", false, "force an update of the blocklist file")
+	flags.DurationVar(&fDNSShutdownTimeout, "shutdownTimeout", 5*time.Second, "how long to wait for in-flight queries on shutdown")
 }
 
 func dnsMain(cmd *cobra.Command, args []string) error {
@@ -33,20 +37,53 @@ func dnsMain(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	go dns.UpdateFakeIP("114.114.114.114:53")
-	go dns.StartAPIServer(viper.GetBool("debug"))
-	dns.NewServer(5*time.Second, 5*time.Second).AsyRun()
+	server := dns.NewServer(dns.Listeners(), 5*time.Second, 5*time.Second)
+	if err := server.AsyRun(); err != nil {
+		return err
+	}
+	if err := dns.StartAPIServer(viper.GetBool("debug"), server); err != nil {
+		server.Shutdown(context.Background())
+		return err
+	}
+
+	// signals are handled while the data is loaded, which downloads for a
+	// while on the first start
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
 
 	// need to resolve domains for file downloads
 	// we should start our dns server firstly
-	if err := dns.LoadData(fDNSForceUpdate); err != nil {
-		return err
-	}
+	loaded := make(chan error, 1)
+	go func() {
+		loaded <- server.LoadData(fDNSForceUpdate)
+	}()
 
-	sig := make(chan os.Signal)
-	signal.Notify(sig, os.Interrupt)
-	<-sig
-	log.Println("signal received")
+loop:
+	for {
+		select {
+		case err := <-loaded:
+			if err != nil {
+				server.Shutdown(context.Background())
+				return err
+			}
+			loaded = nil
+		case s := <-sig:
+			if s != syscall.SIGHUP {
+				log.Printf("signal %s received, shutting down\n", s)
+				break loop
+			}
+			// reloads may download sources, they run in background to keep
+			// shutdown responsive and are serialized by the server
+			log.Printf("signal %s received, reloading config\n", s)
+			go func() {
+				if err := server.Reload(); err != nil {
+					log.Printf("failed to reload config: %s\n", err)
+				}
+			}()
+		}
+	}
 
-	return nil
+	ctx, cancel := context.WithTimeout(context.Background(), fDNSShutdownTimeout)
+	defer cancel()
+	return server.Shutdown(ctx)
 }
@@ -2,16 +2,21 @@ package dns
 
 import (
 	"log"
+	"net"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-contrib/expvar"
 	"github.com/gin-contrib/static"
 	"github.com/gin-gonic/gin"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
 )
 
-// StartAPIServer launches the API server
-func StartAPIServer(debug bool) {
+// StartAPIServer launches the API server, which is stopped by s.Shutdown
+func StartAPIServer(debug bool, s *Server) error {
 	if !debug {
 		gin.SetMode(gin.ReleaseMode)
 	}
@@ -38,10 +43,32 @@ func StartAPIServer(debug bool) {
 		}
 	})
 
+	router.GET("/blockcache/match/:key", func(c *gin.Context) {
+		// the query type and client can be given as ?type=AAAA&client=192.168.1.2,
+		// the rules of the group of the client and of its schedules apply
+		qtype, ok := dns.StringToType[strings.ToUpper(c.DefaultQuery("type", "A"))]
+		if !ok {
+			c.IndentedJSON(http.StatusOK, gin.H{"error": "unknown type " + c.Query("type")})
+			return
+		}
+		client := net.ParseIP(c.Query("client"))
+		group := getConfig().groupOf(client)
+		var rule *BlockRule
+		if group.blocks() {
+			active := getConfig().activeCategories(group, time.Now())
+			rule = gBlockCache.lookup(c.Param("key"), qtype, client, group, active)
+		}
+		c.IndentedJSON(http.StatusOK, gin.H{"blocked": rule != nil && rule.Blocks(), "rule": rule, "group": group.Name()})
+	})
+
 	router.GET("/blockcache/length", func(c *gin.Context) {
 		c.IndentedJSON(http.StatusOK, gin.H{"length": gBlockCache.Length()})
 	})
 
+	router.GET("/blockcache/stats", func(c *gin.Context) {
+		c.IndentedJSON(http.StatusOK, gBlockCache.Stats())
+	})
+
 	router.GET("/blockcache/remove/:key", func(c *gin.Context) {
 		// Removes from BlockCache only. If the domain has already been queried and placed into MemoryCache, will need to wait until item is expired.
 		gBlockCache.Remove(c.Param("key"))
@@ -49,11 +76,30 @@ func StartAPIServer(debug bool) {
 	})
 
 	router.GET("/blockcache/set/:key", func(c *gin.Context) {
-		// MemoryBlockCache Set() always returns nil, so ignoring response.
-		_ = gBlockCache.Set(c.Param("key"), true)
+		// the key is a filter rule, such as a domain or "||example.org^$important"
+		if err := gBlockCache.AddRule(c.Param("key"), "api", 0); err != nil {
+			c.IndentedJSON(http.StatusOK, gin.H{"error": err.Error()})
+			return
+		}
 		c.IndentedJSON(http.StatusOK, gin.H{"success": true})
 	})
 
+	router.GET("/cache", func(c *gin.Context) {
+		c.IndentedJSON(http.StatusOK, gin.H{"cache": s.handler.cache.Stats(), "negcache": s.handler.negCache.Stats()})
+	})
+
+	router.GET("/sources", func(c *gin.Context) {
+		c.IndentedJSON(http.StatusOK, SourceStatuses())
+	})
+
+	router.GET("/schedules", func(c *gin.Context) {
+		c.IndentedJSON(http.StatusOK, ScheduleStatuses())
+	})
+
+	router.GET("/upstreams", func(c *gin.Context) {
+		c.IndentedJSON(http.StatusOK, s.handler.resolver.health.Stats())
+	})
+
 	router.GET("/questioncache", func(c *gin.Context) {
 		c.IndentedJSON(http.StatusOK, gin.H{"length": gQuestionCache.Length(), "items": gQuestionCache.Backend})
 	})
@@ -81,8 +127,32 @@ func StartAPIServer(debug bool) {
 		c.IndentedJSON(http.StatusOK, filteredCache)
 	})
 
-	log.Println("API server listening on ", gConfig.API)
-	if err := router.Run(gConfig.API); err != nil {
-		log.Println("router return err ", err)
+	router.GET("/questioncache/group/:group", func(c *gin.Context) {
+		var filteredCache []QuestionCacheEntry
+
+		gQuestionCache.mu.RLock()
+		for _, entry := range gQuestionCache.Backend {
+			if entry.Group == c.Param("group") {
+				filteredCache = append(filteredCache, entry)
+			}
+		}
+		gQuestionCache.mu.RUnlock()
+
+		c.IndentedJSON(http.StatusOK, filteredCache)
+	})
+
+	ln, err := net.Listen("tcp", getConfig().API)
+	if err != nil {
+		return errors.Wrapf(err, "failed to start API server on %s", getConfig().API)
 	}
+	s.apiServer = &http.Server{Addr: getConfig().API, Handler: router}
+
+	go func() {
+		log.Println("API server listening on ", getConfig().API)
+		if err := s.apiServer.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Println("router return err ", err)
+		}
+	}()
+
+	return nil
 }
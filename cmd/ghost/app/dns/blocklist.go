@@ -0,0 +1,309 @@
+package dns
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"github.com/miekg/dns"
+)
+
+// blockNode is a node of the blocklist trie, children are keyed by the next
+// label to the left, so that a name is found by walking its labels from the
+// top level domain down
+type blockNode struct {
+	children map[string]*blockNode
+	rules    []*BlockRule
+}
+
+// approximate memory used by a node and a rule besides their strings, a map
+// entry costs about a string header, a pointer and the bucket overhead
+var (
+	blockNodeSize = int(unsafe.Sizeof(blockNode{})) + 48
+	blockRuleSize = int(unsafe.Sizeof(BlockRule{})) + 8
+)
+
+// BlockListStats reports the size of a BlockList
+type BlockListStats struct {
+	Rules   int `json:"rules"`
+	Regexps int `json:"regexps"`
+	Nodes   int `json:"nodes"`
+	Bytes   int `json:"bytes"` // estimated memory footprint
+}
+
+// BlockList matches names against the rules of filter lists and response
+// policy zones. A domain rule
+// is stored at the trie node of its domain, so that the rules of a name and
+// its parent domains are found in O(labels), wildcard and regular expression
+// rules are matched one by one.
+//
+// An $important rule beats all others. Otherwise the most specific rule wins,
+// that is the one of the deepest domain, with rules matching the name itself
+// (exact, wildcard and regular expression rules) the most specific. An
+// exception beats a block rule equally specific.
+type BlockList struct {
+	mu      sync.RWMutex
+	root    *blockNode
+	regexps []*BlockRule
+	rules   int
+	nodes   int
+	bytes   int
+}
+
+// NewBlockList returns an empty BlockList
+func NewBlockList() *BlockList {
+	return &BlockList{root: &blockNode{}}
+}
+
+// normalize lowercases name and strips the trailing dot
+func normalize(name string) string {
+	return strings.ToLower(UnFqdn(strings.TrimSpace(name)))
+}
+
+// AddRule parses text as a filter rule and adds it
+func (b *BlockList) AddRule(text, source string, line int) error {
+	rules, err := parseRule(text, source, line)
+	if err != nil {
+		return err
+	}
+	for _, r := range rules {
+		b.Add(r)
+	}
+	return nil
+}
+
+// Add adds a parsed rule
+func (b *BlockList) Add(r *BlockRule) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.rules++
+	b.bytes += blockRuleSize + len(r.Text)
+	if r.regex != nil {
+		b.regexps = append(b.regexps, r)
+		return
+	}
+
+	node := b.root
+	name := r.name
+	for end := len(name); end > 0; {
+		start := strings.LastIndexByte(name[:end], '.') + 1
+		label := name[start:end]
+		child, ok := node.children[label]
+		if !ok {
+			if node.children == nil {
+				node.children = make(map[string]*blockNode)
+			}
+			child = &blockNode{}
+			node.children[label] = child
+			b.nodes++
+			b.bytes += blockNodeSize + len(label)
+		}
+		node = child
+		end = start - 1
+	}
+	node.rules = append(node.rules, r)
+}
+
+// find returns the node of name, or nil if there is none
+func (b *BlockList) find(name string) *blockNode {
+	node := b.root
+	for end := len(name); end > 0 && node != nil; {
+		start := strings.LastIndexByte(name[:end], '.') + 1
+		node = node.children[name[start:end]]
+		end = start - 1
+	}
+	return node
+}
+
+// Lookup returns the rule deciding a query for name of type qtype from
+// client, which may be nil, or nil if no rule matches
+func (b *BlockList) Lookup(name string, qtype uint16, client net.IP) *BlockRule {
+	return b.lookup(name, qtype, client, nil, nil)
+}
+
+// lookup is Lookup with the rules group uses alone, the rules of all
+// lists but none of a group if it is nil, and of the categories in active
+func (b *BlockList) lookup(name string, qtype uint16, client net.IP, group *clientGroup,
+	active map[string]bool) *BlockRule {
+	name = normalize(name)
+	if name == "" {
+		return nil
+	}
+
+	var important, found *BlockRule
+	foundLevel := 0
+	consider := func(r *BlockRule, level int) {
+		if !group.uses(r.Source) || r.Category != "" && !active[r.Category] || !r.applies(name, qtype, client) {
+			return
+		}
+		if r.important {
+			if important == nil || r.allow && !important.allow {
+				important = r
+			}
+			return
+		}
+		if found == nil || level > foundLevel || level == foundLevel && r.allow && !found.allow {
+			found, foundLevel = r, level
+		}
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	labels := strings.Count(name, ".") + 1
+	node := b.root
+	level := 0
+	for end := len(name); end > 0; {
+		start := strings.LastIndexByte(name[:end], '.') + 1
+		if node = node.children[name[start:end]]; node == nil {
+			break
+		}
+		end = start - 1
+		level++
+
+		for _, r := range node.rules {
+			if level == labels && !r.subOnly || level < labels && r.subdomains {
+				consider(r, level)
+			}
+		}
+	}
+	for _, r := range b.regexps {
+		consider(r, labels)
+	}
+
+	if important != nil {
+		return important
+	}
+	return found
+}
+
+// Match reports whether an A query for name is blocked
+func (b *BlockList) Match(name string) bool {
+	r := b.Lookup(name, dns.TypeA, nil)
+	return r != nil && r.Blocks()
+}
+
+// Get returns whether name has a block rule of its own, or an error if it
+// has no rule at all
+func (b *BlockList) Get(name string) (bool, error) {
+	name = normalize(name)
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	node := b.find(name)
+	if node == nil || len(node.rules) == 0 {
+		return false, KeyNotFound{name}
+	}
+	for _, r := range node.rules {
+		if r.Blocks() {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Exists returns whether name has a rule of its own
+func (b *BlockList) Exists(name string) bool {
+	_, err := b.Get(name)
+	return err == nil
+}
+
+// Remove removes the domain rules of name, its subdomains keep theirs
+func (b *BlockList) Remove(name string) {
+	name = normalize(name)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var path []*blockNode
+	var labels []string
+	node := b.root
+	for end := len(name); end > 0 && node != nil; {
+		start := strings.LastIndexByte(name[:end], '.') + 1
+		path = append(path, node)
+		labels = append(labels, name[start:end])
+		node = node.children[name[start:end]]
+		end = start - 1
+	}
+	if node == nil || len(node.rules) == 0 {
+		return
+	}
+	for _, r := range node.rules {
+		b.rules--
+		b.bytes -= blockRuleSize + len(r.Text)
+	}
+	node.rules = nil
+
+	// prune the nodes left without rule and children
+	for i := len(path) - 1; i >= 0 && len(node.rules) == 0 && len(node.children) == 0; i-- {
+		delete(path[i].children, labels[i])
+		b.nodes--
+		b.bytes -= blockNodeSize + len(labels[i])
+		node = path[i]
+	}
+}
+
+// Length returns the number of rules
+func (b *BlockList) Length() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.rules
+}
+
+// Items returns the names which have a block rule, and the text of blocking
+// wildcard and regular expression rules
+func (b *BlockList) Items() []string {
+	var items []string
+	var walk func(node *blockNode, name string)
+	walk = func(node *blockNode, name string) {
+		for _, r := range node.rules {
+			if r.Blocks() {
+				items = append(items, name)
+				break
+			}
+		}
+		for label, child := range node.children {
+			if name == "" {
+				walk(child, label)
+			} else {
+				walk(child, label+"."+name)
+			}
+		}
+	}
+
+	b.mu.RLock()
+	walk(b.root, "")
+	for _, r := range b.regexps {
+		if r.Blocks() {
+			items = append(items, r.Text)
+		}
+	}
+	b.mu.RUnlock()
+	return items
+}
+
+// Replace swaps the content of the BlockList for the content of other
+func (b *BlockList) Replace(other *BlockList) {
+	other.mu.RLock()
+	root, regexps, rules, nodes, bytes := other.root, other.regexps, other.rules, other.nodes, other.bytes
+	other.mu.RUnlock()
+
+	b.mu.Lock()
+	b.root, b.regexps, b.rules, b.nodes, b.bytes = root, regexps, rules, nodes, bytes
+	b.mu.Unlock()
+}
+
+// Stats returns the size of the BlockList
+func (b *BlockList) Stats() BlockListStats {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return BlockListStats{
+		Rules:   b.rules,
+		Regexps: len(b.regexps),
+		Nodes:   b.nodes,
+		Bytes:   blockNodeSize + b.bytes,
+	}
+}
@@ -0,0 +1,131 @@
+package dns
+
+import (
+	"net"
+	"sort"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func newTestBlockList(t *testing.T, rules ...string) *BlockList {
+	b := NewBlockList()
+	for i, rule := range rules {
+		if err := b.AddRule(rule, "test", i+1); err != nil {
+			t.Fatalf("%s: %s", rule, err)
+		}
+	}
+	return b
+}
+
+func TestBlockListMatch(t *testing.T) {
+	b := newTestBlockList(t,
+		"||doubleclick.net^",
+		"0.0.0.0 ads.example.com",
+		"tracker.com",
+		"@@||ok.tracker.com^",
+		"||bad.ok.tracker.com^",
+		"||both.com^",
+		"@@||both.com^",
+	)
+
+	for name, blocked := range map[string]bool{
+		"doubleclick.net":        true,
+		"ad.doubleclick.net.":    true,
+		"AD.DoubleClick.net":     true,
+		"notdoubleclick.net":     false,
+		"net":                    false,
+		"ads.example.com":        true,
+		"www.ads.example.com":    false,
+		"example.com":            false,
+		"tracker.com":            true,
+		"ok.tracker.com":         false,
+		"www.ok.tracker.com":     false,
+		"bad.ok.tracker.com":     true,
+		"www.bad.ok.tracker.com": true,
+		"both.com":               false,
+		"www.both.com":           false,
+		"":                       false,
+	} {
+		if got := b.Match(name); got != blocked {
+			t.Errorf("%q: expected blocked %v, got %v", name, blocked, got)
+		}
+	}
+}
+
+func TestBlockListModifiers(t *testing.T) {
+	b := newTestBlockList(t,
+		"||ads.com^",
+		"@@||ads.com^$client=192.168.1.0/24",
+		"||ads.com^$important,client=192.168.1.66",
+		"||mx.com^$dnstype=MX",
+		"||cdn.com^$denyallow=ok.cdn.com",
+		"/^ad[0-9]+\\./",
+		"@@ad1.allowed.com",
+		"||track*.net^",
+	)
+
+	client := net.ParseIP("192.168.1.2")
+	important := net.ParseIP("192.168.1.66")
+	for _, c := range []struct {
+		name    string
+		qtype   uint16
+		client  net.IP
+		blocked bool
+		line    int
+	}{
+		{"ads.com", dns.TypeA, nil, true, 1},
+		{"ads.com", dns.TypeA, client, false, 2},
+		{"ads.com", dns.TypeA, important, true, 3},
+		{"mx.com", dns.TypeA, nil, false, 0},
+		{"mx.com", dns.TypeMX, nil, true, 4},
+		{"www.cdn.com", dns.TypeA, nil, true, 5},
+		{"ok.cdn.com", dns.TypeA, nil, false, 0},
+		{"www.ok.cdn.com", dns.TypeA, nil, false, 0},
+		{"ad12.example.com", dns.TypeA, nil, true, 6},
+		{"ad1.allowed.com", dns.TypeA, nil, false, 7},
+		{"www.tracker.net", dns.TypeA, nil, true, 8},
+		{"tracker.net.com", dns.TypeA, nil, false, 0},
+	} {
+		r := b.Lookup(c.name, c.qtype, c.client)
+		if blocked := r != nil && r.Blocks(); blocked != c.blocked {
+			t.Errorf("%s %s %v: expected blocked %v, got %v", c.name, dns.TypeToString[c.qtype], c.client, c.blocked, blocked)
+		}
+		if c.line != 0 && (r == nil || r.Line != c.line || r.Source != "test") {
+			t.Errorf("%s %s %v: expected rule of line %d, got %+v", c.name, dns.TypeToString[c.qtype], c.client, c.line, r)
+		}
+	}
+}
+
+func TestBlockListRemove(t *testing.T) {
+	b := newTestBlockList(t, "||a.example.com^", "||b.example.com^")
+	if stats := b.Stats(); stats.Rules != 2 || stats.Nodes != 4 || stats.Bytes <= 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	b.Remove("example.com")
+	if b.Length() != 2 {
+		t.Error("removing a name without rule should change nothing")
+	}
+
+	b.Remove("a.example.com")
+	if b.Match("a.example.com") || !b.Match("x.b.example.com") {
+		t.Error("remove should only drop the rule of the name")
+	}
+	if stats := b.Stats(); stats.Rules != 1 || stats.Nodes != 3 {
+		t.Errorf("removed node was not pruned: %+v", stats)
+	}
+
+	items := b.Items()
+	sort.Strings(items)
+	if len(items) != 1 || items[0] != "b.example.com" {
+		t.Errorf("unexpected items %v", items)
+	}
+
+	if _, err := b.Get("a.example.com"); err == nil {
+		t.Error("removed name should not be found")
+	}
+	if ok, err := b.Get("b.example.com"); !ok || err != nil {
+		t.Error("blocked name should be found")
+	}
+}
@@ -1,6 +1,8 @@
 package dns
 
 import (
+	"container/list"
+	"log"
 	"strings"
 	"sync"
 	"time"
@@ -28,6 +30,16 @@ func (e KeyExpired) Error() string {
 	return e.Key + " " + "expired"
 }
 
+// KeyStale type, returned along with an expired entry which can still be served
+type KeyStale struct {
+	Key string
+}
+
+// Error formats an error for the KeyStale type
+func (e KeyStale) Error() string {
+	return e.Key + " " + "stale"
+}
+
 // CacheIsFull type
 type CacheIsFull struct {
 }
@@ -42,8 +54,28 @@ type Mesg struct {
 	Msg     *dns.Msg
 	Blocked bool
 	Expire  time.Time
+	Stored  time.Time
+	Hits    uint64
+
+	refreshed time.Time
+	elem      *list.Element
 }
 
+// CacheStats reports usage of a Cache
+type CacheStats struct {
+	Length    int    `json:"length"`
+	Maxcount  int    `json:"maxcount"`
+	Evictions uint64 `json:"evictions"`
+	Expired   uint64 `json:"expired"`
+}
+
+const (
+	// staleTTL is the TTL of stale answers, as recommended by RFC 8767
+	staleTTL = 30
+	// refreshRetry is the minimum interval between two background refreshes
+	refreshRetry = 5 * time.Second
+)
+
 // Cache interface
 type Cache interface {
 	Get(key string) (Msg *dns.Msg, blocked bool, err error)
@@ -51,63 +83,234 @@ type Cache interface {
 	Exists(key string) bool
 	Remove(key string)
 	Length() int
+	Refresh(key string) bool
+	Stats() CacheStats
 }
 
-// MemoryCache type
+// MemoryCache type, the least recently used entry is evicted when it is full
 type MemoryCache struct {
 	mu      sync.RWMutex
 	Backend map[string]Mesg
+	lru     *list.List // front is the most recently used key
+
+	evictions uint64
+	expired   uint64
 
+	// Expire is used for entries which carry no TTL
 	Expire   time.Duration
+	MinTTL   time.Duration
+	MaxTTL   time.Duration
 	Maxcount int
+
+	// StaleWindow is how long an expired entry can still be served
+	StaleWindow time.Duration
+	// entries with at least PrefetchHits hits are refreshed in PrefetchWindow before expiry
+	PrefetchWindow time.Duration
+	PrefetchHits   uint64
 }
 
-// Get returns the entry for a key or an error
+// Get returns the entry for a key or an error, an expired entry within
+// StaleWindow is returned along with a KeyStale error
 func (c *MemoryCache) Get(key string) (*dns.Msg, bool, error) {
 	key = strings.ToLower(key)
 
-	c.mu.RLock()
+	c.mu.Lock()
 	mesg, ok := c.Backend[key]
-	c.mu.RUnlock()
+	if ok {
+		mesg.Hits++
+		c.Backend[key] = mesg
+		if mesg.elem != nil {
+			c.lru.MoveToFront(mesg.elem)
+		}
+	}
+	c.mu.Unlock()
 
 	if !ok {
 		return nil, false, KeyNotFound{key}
 	}
 
-	if mesg.Expire.Before(time.Now()) {
-		c.Remove(key)
-		return nil, false, KeyExpired{key}
+	now := time.Now()
+	if mesg.Expire.Before(now) {
+		if mesg.Msg == nil || mesg.Blocked || mesg.Expire.Add(c.StaleWindow).Before(now) {
+			c.mu.Lock()
+			if cur, ok := c.Backend[key]; ok && cur.Expire.Equal(mesg.Expire) {
+				c.remove(key)
+				c.expired++
+			}
+			c.mu.Unlock()
+			return nil, false, KeyExpired{key}
+		}
+
+		// every record has outlived its TTL, so all are set to staleTTL
+		msg := mesg.Msg.Copy()
+		ageTTL(msg, ^uint32(0), staleTTL)
+		return msg, false, KeyStale{key}
+	}
+
+	if mesg.Msg == nil {
+		return nil, mesg.Blocked, nil
+	}
+
+	// count TTLs down, the stored message must stay untouched
+	msg := mesg.Msg.Copy()
+	// elapsed is rounded down and remain up, an entry just stored keeps the TTL
+	elapsed := uint32(now.Sub(mesg.Stored) / time.Second)
+	remain := uint32((mesg.Expire.Sub(now) + time.Second - 1) / time.Second)
+	ageTTL(msg, elapsed, remain)
+
+	return msg, mesg.Blocked, nil
+}
+
+// Refresh reports whether the entry should be refreshed in background,
+// either because it is stale or because it is hot and about to expire.
+// It returns true at most once every refreshRetry for each entry.
+func (c *MemoryCache) Refresh(key string) bool {
+	key = strings.ToLower(key)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	mesg, ok := c.Backend[key]
+	if !ok || mesg.Msg == nil || mesg.Blocked {
+		return false
+	}
+
+	now := time.Now()
+	if mesg.refreshed.Add(refreshRetry).After(now) {
+		return false
+	}
+
+	stale := mesg.Expire.Before(now)
+	hot := c.PrefetchWindow > 0 && mesg.Hits >= c.PrefetchHits &&
+		mesg.Expire.Sub(now) < c.PrefetchWindow
+	if !stale && !hot {
+		return false
 	}
 
-	return mesg.Msg, mesg.Blocked, nil
+	mesg.refreshed = now
+	c.Backend[key] = mesg
+	return true
 }
 
-// Set sets a keys value to a Mesg
+// Set sets a keys value to a Mesg, an answer with a TTL of 0 must not be
+// cached, it replaces no entry either
 func (c *MemoryCache) Set(key string, msg *dns.Msg, blocked bool) error {
 	key = strings.ToLower(key)
 
-	if c.Full() && !c.Exists(key) {
-		return CacheIsFull{}
+	now := time.Now()
+	expire := now.Add(c.Expire)
+	if ttl, ok := msgTTL(msg); ok && !blocked {
+		if ttl == 0 {
+			c.Remove(key)
+			return nil
+		}
+		expire = now.Add(c.clampTTL(time.Duration(ttl) * time.Second))
 	}
+	return c.restore(key, Mesg{Msg: msg, Blocked: blocked, Expire: expire, Stored: now})
+}
+
+// restore inserts an entry as it is, as the most recently used one
+func (c *MemoryCache) restore(key string, mesg Mesg) error {
+	key = strings.ToLower(key)
 
-	expire := time.Now().Add(c.Expire)
-	mesg := Mesg{msg, blocked, expire}
 	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.lru == nil {
+		c.lru = list.New()
+	}
+	if old, ok := c.Backend[key]; ok && old.elem != nil {
+		mesg.elem = old.elem
+		c.lru.MoveToFront(mesg.elem)
+	} else {
+		if c.Maxcount != 0 && len(c.Backend) >= c.Maxcount && !c.evict() {
+			return CacheIsFull{}
+		}
+		mesg.elem = c.lru.PushFront(key)
+	}
 	c.Backend[key] = mesg
-	c.mu.Unlock()
 
 	return nil
 }
 
+// evict removes the least recently used entry, c.mu must be held
+func (c *MemoryCache) evict() bool {
+	elem := c.lru.Back()
+	if elem == nil {
+		return false
+	}
+	c.remove(elem.Value.(string))
+	c.evictions++
+	return true
+}
+
+// remove removes an entry, c.mu must be held
+func (c *MemoryCache) remove(key string) {
+	if mesg, ok := c.Backend[key]; ok && mesg.elem != nil {
+		c.lru.Remove(mesg.elem)
+	}
+	delete(c.Backend, key)
+}
+
 // Remove removes an entry from the cache
 func (c *MemoryCache) Remove(key string) {
 	key = strings.ToLower(key)
 
 	c.mu.Lock()
-	delete(c.Backend, key)
+	c.remove(key)
 	c.mu.Unlock()
 }
 
+// Janitor removes entries which can no longer be served every interval until stop is closed
+func (c *MemoryCache) Janitor(interval time.Duration, stop <-chan struct{}) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if n := c.Sweep(); n > 0 {
+				log.Printf("janitor removed %d expired cache entries\n", n)
+			}
+		}
+	}
+}
+
+// Sweep removes entries which expired beyond StaleWindow and returns the count
+func (c *MemoryCache) Sweep() int {
+	deadline := time.Now().Add(-c.StaleWindow)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := 0
+	for key, mesg := range c.Backend {
+		if mesg.Expire.Before(deadline) {
+			c.remove(key)
+			n++
+		}
+	}
+	c.expired += uint64(n)
+	return n
+}
+
+// Stats returns the usage of the cache
+func (c *MemoryCache) Stats() CacheStats {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return CacheStats{
+		Length:    len(c.Backend),
+		Maxcount:  c.Maxcount,
+		Evictions: c.evictions,
+		Expired:   c.expired,
+	}
+}
+
 // Exists returns whether or not a key exists in the cache
 func (c *MemoryCache) Exists(key string) bool {
 	key = strings.ToLower(key)
@@ -133,6 +336,118 @@ func (c *MemoryCache) Full() bool {
 	return c.Length() >= c.Maxcount
 }
 
+func (c *MemoryCache) clampTTL(ttl time.Duration) time.Duration {
+	if ttl < c.MinTTL {
+		ttl = c.MinTTL
+	}
+	if c.MaxTTL > 0 && ttl > c.MaxTTL {
+		ttl = c.MaxTTL
+	}
+	return ttl
+}
+
+// msgTTL returns the smallest TTL of the answer section, for negative answers
+// the SOA in authority section is taken into account as described in RFC 2308
+func msgTTL(m *dns.Msg) (uint32, bool) {
+	if m == nil {
+		return 0, false
+	}
+
+	var ttl uint32
+	ok := false
+	for _, rr := range m.Answer {
+		if !ok || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+			ok = true
+		}
+	}
+	if soa := soaRecord(m); soa != nil {
+		negTTL := soa.Hdr.Ttl
+		if soa.Minttl < negTTL {
+			negTTL = soa.Minttl
+		}
+		if !ok || negTTL < ttl {
+			ttl = negTTL
+			ok = true
+		}
+	}
+	return ttl, ok
+}
+
+// soaRecord returns the SOA record of the authority section, if any
+func soaRecord(m *dns.Msg) *dns.SOA {
+	for _, rr := range m.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa
+		}
+	}
+	return nil
+}
+
+// cacheableMsg reports whether an upstream answer can be cached, which is a
+// successful answer whose CNAME chain ends in records of the question type,
+// or a NODATA answer (possibly after a CNAME chain) with SOA in authority
+func cacheableMsg(m *dns.Msg) bool {
+	if m == nil || m.Rcode != dns.RcodeSuccess || m.Truncated || len(m.Question) == 0 {
+		return false
+	}
+	return soaRecord(m) != nil || chainComplete(m)
+}
+
+// negativeMsg reports whether an upstream answer is a NXDOMAIN which can be
+// cached, RFC 2308 requires a SOA in authority for this
+func negativeMsg(m *dns.Msg) bool {
+	return m != nil && m.Rcode == dns.RcodeNameError && soaRecord(m) != nil
+}
+
+// chainComplete follows the CNAME chain from the question name through the
+// answer section and reports whether it ends in records of the question type
+func chainComplete(m *dns.Msg) bool {
+	q := m.Question[0]
+	name := q.Name
+	// a chain can't be longer than the answer section, this also stops loops
+	for range m.Answer {
+		next := ""
+		for _, rr := range m.Answer {
+			hdr := rr.Header()
+			if !strings.EqualFold(hdr.Name, name) {
+				continue
+			}
+			if hdr.Rrtype == q.Qtype {
+				return true
+			}
+			if cname, ok := rr.(*dns.CNAME); ok {
+				next = cname.Target
+			}
+		}
+		if next == "" {
+			return false
+		}
+		name = next
+	}
+	return false
+}
+
+// ageTTL decreases the TTL of all records by elapsed seconds, capped at the
+// remaining lifespan of the entry, so that clients don't keep an answer longer
+// than the cache (clamped by MaxTTL). Records which outlived their TTL (raised
+// by MinTTL) are served with the remaining lifespan.
+func ageTTL(m *dns.Msg, elapsed, remain uint32) {
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			if hdr.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if hdr.Ttl > elapsed && hdr.Ttl-elapsed < remain {
+				hdr.Ttl -= elapsed
+			} else {
+				hdr.Ttl = remain
+			}
+		}
+	}
+}
+
 // MemoryBlockCache type
 type MemoryBlockCache struct {
 	mu      sync.RWMutex
@@ -234,7 +549,7 @@ func (c *MemoryQuestionCache) Length() int {
 
 var (
 	// gBlockCache contains all blocked domains
-	gBlockCache = &MemoryBlockCache{Backend: make(map[string]bool)}
+	gBlockCache = NewBlockList()
 	// gFakeIPCache contains all fake ips
 	gFakeIPCache = &MemoryBlockCache{Backend: make(map[string]bool)}
 	// gQuestionCache contains all queries to the dns server
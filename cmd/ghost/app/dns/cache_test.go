@@ -2,8 +2,12 @@ package dns
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
 )
@@ -14,9 +18,9 @@ func TestCache(t *testing.T) {
 	)
 
 	cache := &MemoryCache{
-		Backend:  make(map[string]Mesg, gConfig.Maxcount),
-		Expire:   gConfig.Expire.Duration,
-		Maxcount: gConfig.Maxcount,
+		Backend:  make(map[string]Mesg, getConfig().Maxcount),
+		Expire:   getConfig().Expire.Duration,
+		Maxcount: getConfig().Maxcount,
 	}
 
 	m := new(dns.Msg)
@@ -66,3 +70,296 @@ func TestBlockCache(t *testing.T) {
 		t.Error("fuzz existed in block cache")
 	}
 }
+
+func TestCacheTTL(t *testing.T) {
+	cache := &MemoryCache{
+		Backend: make(map[string]Mesg),
+		Expire:  time.Hour,
+		MinTTL:  5 * time.Second,
+		MaxTTL:  time.Minute,
+	}
+
+	newMsg := func(ttls ...uint32) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
+		for _, ttl := range ttls {
+			rr, _ := dns.NewRR(fmt.Sprintf("%s %d IN A 127.0.0.1", dns.Fqdn(testDomain), ttl))
+			m.Answer = append(m.Answer, rr)
+		}
+		return m
+	}
+
+	cases := []struct {
+		ttls   []uint32
+		expire time.Duration
+	}{
+		{[]uint32{300, 30}, 30 * time.Second},
+		{[]uint32{1}, 5 * time.Second},
+		{[]uint32{7200}, time.Minute},
+	}
+	for _, c := range cases {
+		if err := cache.Set(testDomain, newMsg(c.ttls...), false); err != nil {
+			t.Fatal(err)
+		}
+		mesg := cache.Backend[testDomain]
+		if got := mesg.Expire.Sub(mesg.Stored); got != c.expire {
+			t.Errorf("ttls %v: expected lifespan %s, got %s", c.ttls, c.expire, got)
+		}
+	}
+
+	// pretend the entry was stored 10 seconds ago
+	cache.Set(testDomain, newMsg(300, 30), false)
+	mesg := cache.Backend[testDomain]
+	mesg.Stored = mesg.Stored.Add(-10 * time.Second)
+	mesg.Expire = mesg.Expire.Add(-10 * time.Second)
+	cache.Backend[testDomain] = mesg
+
+	m, _, err := cache.Get(testDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// no record outlives the entry, which expires with the 30s record
+	if ttl := m.Answer[0].Header().Ttl; ttl != 20 {
+		t.Errorf("expected ttl 20, got %d", ttl)
+	}
+	if ttl := m.Answer[1].Header().Ttl; ttl != 20 {
+		t.Errorf("expected ttl 20, got %d", ttl)
+	}
+	if ttl := cache.Backend[testDomain].Msg.Answer[0].Header().Ttl; ttl != 300 {
+		t.Errorf("stored message modified, ttl %d", ttl)
+	}
+
+	// the TTL served is clamped by MaxTTL, like the lifespan
+	cache.Set(testDomain, newMsg(7200), false)
+	m, _, err = cache.Get(testDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl := m.Answer[0].Header().Ttl; ttl != 60 {
+		t.Errorf("expected ttl 60, got %d", ttl)
+	}
+}
+
+func TestCacheStaleAndRefresh(t *testing.T) {
+	cache := &MemoryCache{
+		Backend:        make(map[string]Mesg),
+		StaleWindow:    time.Minute,
+		PrefetchWindow: 10 * time.Second,
+		PrefetchHits:   2,
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
+	rr, _ := dns.NewRR(dns.Fqdn(testDomain) + " 5 IN A 127.0.0.1")
+	m.Answer = append(m.Answer, rr)
+	cache.Set(testDomain, m, false)
+
+	// not hot enough yet
+	cache.Get(testDomain)
+	if cache.Refresh(testDomain) {
+		t.Error("entry with 1 hit should not be prefetched")
+	}
+	cache.Get(testDomain)
+	if !cache.Refresh(testDomain) {
+		t.Error("hot entry should be prefetched")
+	}
+	if cache.Refresh(testDomain) {
+		t.Error("entry should be refreshed only once")
+	}
+
+	// expire the entry
+	mesg := cache.Backend[testDomain]
+	mesg.Expire = time.Now().Add(-time.Second)
+	mesg.refreshed = time.Time{}
+	cache.Backend[testDomain] = mesg
+
+	msg, _, err := cache.Get(testDomain)
+	if _, ok := err.(KeyStale); !ok {
+		t.Fatalf("expected stale entry, got %v", err)
+	}
+	if ttl := msg.Answer[0].Header().Ttl; ttl != staleTTL {
+		t.Errorf("expected stale ttl %d, got %d", staleTTL, ttl)
+	}
+	if !cache.Refresh(testDomain) {
+		t.Error("stale entry should be refreshed")
+	}
+
+	// beyond the stale window
+	mesg = cache.Backend[testDomain]
+	mesg.Expire = time.Now().Add(-2 * time.Minute)
+	cache.Backend[testDomain] = mesg
+	if _, _, err := cache.Get(testDomain); err == nil {
+		t.Error("entry beyond stale window should not be served")
+	}
+
+	// an answer with TTL 0 is not cached, so it is never served stale
+	rr, _ = dns.NewRR(dns.Fqdn(testDomain) + " 0 IN A 127.0.0.1")
+	m.Answer = []dns.RR{rr}
+	cache.Set(testDomain, m, false)
+	if msg, _, _ := cache.Get(testDomain); msg != nil {
+		t.Errorf("answer with ttl 0 should not be cached: %v", msg)
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	cache := &MemoryCache{
+		Backend:  make(map[string]Mesg),
+		Expire:   time.Hour,
+		Maxcount: 2,
+	}
+
+	for _, key := range []string{"a", "b"} {
+		if err := cache.Set(key, nil, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// "a" becomes the most recently used, so "b" is evicted
+	cache.Get("a")
+	if err := cache.Set("c", nil, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if cache.Exists("b") {
+		t.Error("least recently used entry was not evicted")
+	}
+	if !cache.Exists("a") || !cache.Exists("c") {
+		t.Error("recently used entries were evicted")
+	}
+	if stats := cache.Stats(); stats.Length != 2 || stats.Evictions != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	mesg := cache.Backend["a"]
+	mesg.Expire = time.Now().Add(-time.Second)
+	cache.Backend["a"] = mesg
+	if n := cache.Sweep(); n != 1 || cache.Exists("a") {
+		t.Errorf("sweep removed %d entries, expected the expired one", n)
+	}
+	if cache.lru.Len() != cache.Length() {
+		t.Errorf("lru has %d keys, backend has %d", cache.lru.Len(), cache.Length())
+	}
+}
+
+func TestFileCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "cache.snapshot")
+	cache := &FileCache{&MemoryCache{Backend: make(map[string]Mesg)}, path}
+
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
+	rr, _ := dns.NewRR(dns.Fqdn(testDomain) + " 300 IN A 127.0.0.1")
+	m.Answer = append(m.Answer, rr)
+	cache.Set(testDomain, m, false)
+	cache.Set("blocked.com", m, true)
+
+	if err := cache.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := &FileCache{&MemoryCache{Backend: make(map[string]Mesg)}, path}
+	if err := loaded.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Exists("blocked.com") {
+		t.Error("blocked entry should not be saved")
+	}
+	msg, _, err := loaded.Get(testDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Answer) != 1 || msg.Answer[0].(*dns.A).A.String() != "127.0.0.1" {
+		t.Errorf("unexpected answer %v", msg.Answer)
+	}
+	if !loaded.Backend[testDomain].Expire.Equal(cache.Backend[testDomain].Expire) {
+		t.Error("expiry changed across snapshot")
+	}
+}
+
+func TestCacheableMsg(t *testing.T) {
+	newMsg := func(qtype uint16, answer []string, ns []string) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion("www.example.com.", qtype)
+		for _, s := range answer {
+			rr, err := dns.NewRR(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m.Answer = append(m.Answer, rr)
+		}
+		for _, s := range ns {
+			rr, err := dns.NewRR(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m.Ns = append(m.Ns, rr)
+		}
+		return m
+	}
+
+	soa := "example.com. 3600 IN SOA ns.example.com. admin.example.com. 1 7200 900 1209600 60"
+	cases := []struct {
+		name      string
+		msg       *dns.Msg
+		cacheable bool
+		ttl       uint32
+	}{
+		{"mx", newMsg(dns.TypeMX, []string{"www.example.com. 300 IN MX 10 mail.example.com."}, nil), true, 300},
+		{"cname chain", newMsg(dns.TypeA, []string{
+			"www.example.com. 600 IN CNAME cdn.example.net.",
+			"cdn.example.net. 120 IN CNAME edge.example.org.",
+			"edge.example.org. 20 IN A 127.0.0.1",
+		}, nil), true, 20},
+		{"broken chain", newMsg(dns.TypeA, []string{
+			"www.example.com. 600 IN CNAME cdn.example.net.",
+		}, nil), false, 600},
+		{"cname loop", newMsg(dns.TypeA, []string{
+			"www.example.com. 600 IN CNAME cdn.example.net.",
+			"cdn.example.net. 600 IN CNAME www.example.com.",
+		}, nil), false, 600},
+		{"nodata", newMsg(dns.TypeTXT, nil, []string{soa}), true, 60},
+		{"nodata after cname", newMsg(dns.TypeAAAA, []string{
+			"www.example.com. 30 IN CNAME cdn.example.net.",
+		}, []string{soa}), true, 30},
+		{"empty", newMsg(dns.TypeA, nil, nil), false, 0},
+	}
+	for _, c := range cases {
+		if got := cacheableMsg(c.msg); got != c.cacheable {
+			t.Errorf("%s: expected cacheable %v, got %v", c.name, c.cacheable, got)
+		}
+		if ttl, _ := msgTTL(c.msg); ttl != c.ttl {
+			t.Errorf("%s: expected ttl %d, got %d", c.name, c.ttl, ttl)
+		}
+	}
+}
+
+func TestNegativeMsg(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("nx.example.com.", dns.TypeA)
+	m.Rcode = dns.RcodeNameError
+	if negativeMsg(m) {
+		t.Error("NXDOMAIN without SOA should not be cached")
+	}
+
+	soa, _ := dns.NewRR("example.com. 3600 IN SOA ns.example.com. admin.example.com. 1 7200 900 1209600 60")
+	m.Ns = append(m.Ns, soa)
+	if !negativeMsg(m) || cacheableMsg(m) {
+		t.Error("NXDOMAIN with SOA should be cached negatively only")
+	}
+
+	cache := &MemoryCache{Backend: make(map[string]Mesg), Expire: 5 * time.Second}
+	cache.Set("nx.example.com", m, false)
+	mesg := cache.Backend["nx.example.com"]
+	if got := mesg.Expire.Sub(mesg.Stored); got != time.Minute {
+		t.Errorf("expected negative lifespan of SOA minimum, got %s", got)
+	}
+	cache.Set("fail.example.com", nil, false)
+	mesg = cache.Backend["fail.example.com"]
+	if got := mesg.Expire.Sub(mesg.Stored); got != 5*time.Second {
+		t.Errorf("expected failure lifespan 5s, got %s", got)
+	}
+}
@@ -2,8 +2,10 @@ package dns
 
 import (
 	"io"
+	"net"
 	"os"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/BurntSushi/toml"
@@ -22,27 +24,57 @@ func (d *duration) UnmarshalText(text []byte) (err error) {
 type config struct {
 	Sources          []string
 	EasyLists        []string
+	RPZ              []string
 	GeoIPSrc         string
 	GeoIPName        string
 	DataDir          string
 	Blocklist        []string
 	Whitelist        []string
 	Bind             string
+	Listen           []Listener
+	TLSBind          string
+	TLSCert          string
+	TLSKey           string
+	HTTPSBind        string
+	HTTPSCert        string
+	HTTPSKey         string
 	API              string
 	Nullroute        string
 	Nullroutev6      string
+	BlockMode        string
 	Nameservers      []string
 	CHNameservers    []string
 	ISPNameservers   []string
+	Upstreams        map[string][]string
+	Routes           []route
+	Groups           []group
+	Categories       map[string][]string
+	Schedules        []schedule
 	Interval         duration
 	Timeout          duration
 	SessionTimeout   duration
+	ProbeInterval    duration
+	ReloadInterval   duration
+	UpdateInterval   duration
+	DownloadTimeout  duration
 	Expire           duration
+	FailureTTL       duration
+	MinTTL           duration
+	MaxTTL           duration
+	StaleWindow      duration
+	PrefetchWindow   duration
+	PrefetchHits     uint64
 	Maxcount         int
+	CacheType        string
+	CacheFile        string
+	JanitorInterval  duration
 	QuestionCacheCap int
 	TTL              uint32
 	FakeInterval     duration
 	FakeIps          []string
+
+	groups    []*clientGroup // compiled Groups, followed by the default group
+	schedules []*clientSchedule
 }
 
 var defaultConfig = `# list of sources to pull blocklists from, stores them in datadir
@@ -57,13 +89,20 @@ sources = [
 	"https://raw.githubusercontent.com/quidsup/notrack/master/trackers.txt"
 ]
 
-# easylists from adblock
+# easylists from adblock, the AdGuard DNS filtering syntax is supported:
+# "||domain^", "|domain^", wildcards, "/regex/" and "@@" exceptions with the
+# $important, $client, $dnstype and $denyallow modifiers, other rules are skipped
 easylists = [
 	"https://easylist-downloads.adblockplus.org/easylistchina+easylist.txt",
 	"https://easylist-downloads.adblockplus.org/easyprivacy.txt",
 	"https://raw.githubusercontent.com/cjx82630/cjxlist/master/cjx-annoyance.txt"
 ]
 
+# response policy zones, urls or local files, with QNAME triggers and the
+# NXDOMAIN, NODATA, PASSTHRU, DROP and local data actions, local files are
+# read again on reload
+rpz = []
+
 # source of GeoIP database
 geoipSrc = "http://geolite.maxmind.com/download/geoip/database/GeoLite2-City.mmdb.gz"
 
@@ -73,10 +112,22 @@ geoipName = "GeoLite2-City.mmdb"
 # locations to store blocklist files and GeoIP database
 datadir = "./data"
 
-# manual blocklist entries
+# sources and easylists are downloaded again every updateInterval, using
+# conditional requests, and the blocklist is rebuilt when any changed,
+# "0s" to only download missing lists on startup
+updateInterval = "24h"
+
+# time limit of a list or GeoIP download, a download which takes longer is
+# retried like one which failed
+downloadTimeout = "2m"
+
+# manual blocklist entries, filter rules as in easylists, a plain domain is
+# blocked with its subdomains, while names after an ip in hosts files are
+# blocked alone
 blocklist = []
 
-# manual whitelist entries
+# manual whitelist entries, filter rules with "@@" implied, which allow the
+# domain and its subdomains unless a more specific domain is blocked
 whitelist = [
 	"126.com",
 	"163.com",
@@ -88,16 +139,51 @@ whitelist = [
 # address to bind to for the DNS server
 bind = "0.0.0.0:53"
 
+# address to bind to for the DNS over TLS server (usually port 853), disabled if empty
+tlsBind = ""
+
+# certificate and key of the DNS over TLS server, a self-signed certificate
+# is generated if neither exists
+tlsCert = "cert.pem"
+tlsKey = "key.pem"
+
+# address to bind to for the DNS over HTTPS server (path /dns-query), disabled if empty
+httpsBind = ""
+
+# certificate and key of the DNS over HTTPS server, generated like tlsCert
+httpsCert = "cert.pem"
+httpsKey = "key.pem"
+
+# more addresses to listen on are configured by [[listen]] tables at the end
+
 # address to bind to for the API server
 api = "127.0.0.1:8080"
 
-# ipv4 address to forward blocked queries to
+# answer to queries of any type for blocked names, one of
+#   "ip"        A and AAAA queries get nullroute and nullroutev6, set them to
+#               the address of a local "blocked" page if you like, others NODATA
+#   "null"      A and AAAA queries get 0.0.0.0 and ::, others NODATA
+#   "nxdomain"  the name does not exist
+#   "refused"   the query is refused
+#   "nodata"    the name exists but has no records of the type
+blockMode = "ip"
+
+# ipv4 address to forward blocked queries to, empty for NODATA
 nullroute = "0.0.0.0"
 
-# ipv6 address to forward blocked queries to
+# ipv6 address to forward blocked queries to, empty for NODATA
 nullroutev6 = "0:0:0:0:0:0:0:0"
 
-# nameservers(not in China) to forward queries to
+# TTL in seconds of answers to blocked queries, which is also the time
+# NXDOMAIN and NODATA answers are cached by clients
+ttl = 10
+
+# nameservers(not in China) to forward queries to, any nameserver list accepts
+#   "ip:port" for plain dns
+#   "https://host/dns-query" for DNS over HTTPS (POST), append "{?dns}" to the
+#     url to use GET instead, use an ip as host to avoid bootstrap lookups
+#   "tls://ip:port#servername" for DNS over TLS, port defaults to 853, the
+#     certificate can be pinned with "tls://ip:port?pin=base64(sha256(spki))#servername"
 nameservers = [
 	"208.67.222.222:443", # opendns
 	"208.67.222.222:5353", # opendns
@@ -138,16 +224,51 @@ timeout = "800ms"
 # timeout for one dns lookup session(one message for on target)
 sessiontimeout = "2s"
 
-# cache entry lifespan
+# nameservers are tried fastest first, one which failed 3 times in a row is not
+# used until it answers a probe again, probes are sent every probeInterval
+probeInterval = "30s"
+
+# this file is reloaded when it changes (checked every reloadInterval) or on
+# SIGHUP, "0s" to only reload on SIGHUP, changes to listen addresses, certificates,
+# api, datadir, geoip, timeout, intervals and cache settings need a restart
+reloadInterval = "5s"
+
+# lifespan of cache entries without TTL
 expire = "3600s"
 
-# cache capacity, 0 for infinite
+# lifespan of cached upstream failures (timeouts, SERVFAIL), NXDOMAIN and NODATA
+# answers are cached for their SOA minimum TTL instead
+failureTTL = "5s"
+
+# answers are cached for the smallest TTL in them, clamped to [minTTL, maxTTL]
+# maxTTL "0s" means no upper limit
+minTTL = "0s"
+maxTTL = "86400s"
+
+# expired answers are still served (with TTL 30) for this long while they are
+# refreshed in background, as described in RFC 8767, "0s" to disable
+staleWindow = "1h"
+
+# answers queried at least prefetchHits times are refreshed in background
+# when they expire within prefetchWindow, "0s" to disable
+prefetchWindow = "10s"
+prefetchHits = 3
+
+# cache capacity, 0 for infinite, the least recently used entry is evicted when full
 maxcount = 0
 
+# cache type, "memory" or "file", a file cache is saved to cachefile in datadir
+# on shutdown and loaded again on startup
+cacheType = "memory"
+cacheFile = "cache.snapshot"
+
+# interval for removing expired cache entries, "0s" to disable
+janitorInterval = "5m"
+
 # question cache capacity, 0 for infinite but not recommended (this is used for storing logs)
 questioncachecap = 5000
 
-# interval for fake ip discovery
+# interval for fake ip discovery, "0s" to disable
 fakeInterval = "30s"
 
 # fake ip for cold boot, please change it for your networks
@@ -161,10 +282,99 @@ fakeIPs = [
 	"59.24.3.173",
 	"37.61.54.158"
 ]
+
+# named nameserver groups for routes and client groups, besides the builtin "nameservers",
+# "chnameservers" and "ispnameservers"
+# [upstreams]
+# corp = ["10.0.0.53:53"]
+# family = ["185.228.168.168:53", "185.228.169.168:53"]
+
+# queries for domains (and their subdomains) of a route only go to its upstream
+# group, files list one domain per line or dnsmasq rules like
+# "server=/example.com/114.114.114.114", as in dnsmasq-china-list
+# [[routes]]
+# domains = ["corp.example.com"]
+# files = []
+# upstream = "ispnameservers"
+#
+# [[routes]]
+# domains = []
+# files = ["./data/accelerated-domains.china.conf"]
+# upstream = "chnameservers"
+
+# policies for groups of clients, matched by ip, cidr or mac address (of ipv4
+# clients in the ARP table) in order, clients of no group get the defaults.
+# A group blocks with the given lists alone, which may be lists not among
+# easylists, sources and rpz to use them for the group only, or with all lists
+# of those when empty. Its blocklist and whitelist entries apply on top of the
+# global ones, names without route are resolved on its upstream group instead
+# of the builtin ones, and blocking = false turns blocking off for it.
+# [[groups]]
+# name = "kids"
+# clients = ["192.168.1.32/28", "aa:bb:cc:dd:ee:ff"]
+# lists = ["https://raw.githubusercontent.com/StevenBlack/hosts/master/hosts"]
+# blocklist = ["youtube.com"]
+# whitelist = []
+# upstream = "family"
+#
+# [[groups]]
+# name = "servers"
+# clients = ["10.0.0.0/24"]
+# blocking = false
+
+# categories of lists, urls or local files like easylists, the rules of which
+# only block while a schedule of their category is active, even for lists
+# among easylists, sources or rpz
+# [categories]
+# social = ["https://example.org/social.txt"]
+# gaming = ["https://example.org/gaming.txt"]
+
+# schedules block the lists of their categories for the clients of their
+# groups (all clients when empty) on days ("mon" to "sun", every day when
+# empty) from start to end local time. A window ending before it starts ends
+# on the next day, so the one below blocks from 21:00 to 07:00 the next
+# morning on the nights of Monday to Friday, and a window ending when it
+# starts lasts all day.
+# [[schedules]]
+# name = "bedtime"
+# groups = ["kids"]
+# categories = ["social", "gaming"]
+# days = ["mon", "tue", "wed", "thu", "fri"]
+# start = "21:00"
+# end = "07:00"
+
+# addresses to listen on, each with its own protocols among "udp", "tcp",
+# "tcp-tls" (DNS over TLS) and "https" (DNS over HTTPS), bind, tlsBind and
+# httpsBind are ignored when any is given. The host can be an interface name
+# to listen on all addresses of that interface.
+# [[listen]]
+# addr = "192.168.1.1:53"
+# net = ["udp", "tcp"]
+#
+# [[listen]]
+# addr = "[fd00::1]:53"
+# net = ["udp", "tcp"]
+#
+# [[listen]]
+# addr = "eth0:853"
+# net = ["tcp-tls"]
 `
 
-// Config is the global configuration
-var gConfig config
+var (
+	// gConfig holds the global *config, which is replaced as a whole on reload
+	gConfig atomic.Value
+	// gConfigPath is the config file loaded by LoadConfig
+	gConfigPath string
+)
+
+func init() {
+	gConfig.Store(&config{})
+}
+
+// getConfig returns the current global configuration, which must not be modified
+func getConfig() *config {
+	return gConfig.Load().(*config)
+}
 
 // LoadConfig loads the given config file
 func LoadConfig(path string) error {
@@ -174,19 +384,135 @@ func LoadConfig(path string) error {
 		}
 	}
 
-	if _, err := toml.Decode(defaultConfig, &gConfig); err != nil {
-		return errors.Wrap(err, "failed to load default config")
+	c, err := readConfig(path)
+	if err != nil {
+		return err
+	}
+
+	gConfigPath = path
+	setConfig(c)
+
+	return nil
+}
+
+// readConfig reads and validates a config file over the default config
+func readConfig(path string) (*config, error) {
+	c := &config{}
+	if _, err := toml.Decode(defaultConfig, c); err != nil {
+		return nil, errors.Wrap(err, "failed to load default config")
+	}
+
+	if _, err := toml.DecodeFile(path, c); err != nil {
+		return nil, errors.Wrap(err, "failed to load config")
 	}
 
-	if _, err := toml.DecodeFile(path, &gConfig); err != nil {
-		return errors.Wrap(err, "failed to load config")
+	if err := validateConfig(c); err != nil {
+		return nil, err
 	}
+	c.groups, _ = parseGroups(c)
+	c.schedules, _ = parseSchedules(c)
 
-	gQuestionCache.Maxcount = gConfig.QuestionCacheCap
+	return c, nil
+}
+
+func setConfig(c *config) {
+	gConfig.Store(c)
+
+	gQuestionCache.mu.Lock()
+	gQuestionCache.Maxcount = c.QuestionCacheCap
+	gQuestionCache.mu.Unlock()
+}
+
+// Listeners returns the configured listen addresses, which are derived from
+// bind, tlsBind and httpsBind unless listen is given
+func Listeners() []Listener {
+	c := getConfig()
+	if len(c.Listen) > 0 {
+		return c.Listen
+	}
+
+	listeners := []Listener{{c.Bind, []string{"udp", "tcp"}}}
+	if c.TLSBind != "" {
+		listeners = append(listeners, Listener{c.TLSBind, []string{"tcp-tls"}})
+	}
+	if c.HTTPSBind != "" {
+		listeners = append(listeners, Listener{c.HTTPSBind, []string{"https"}})
+	}
+	return listeners
+}
+
+func validateConfig(c *config) error {
+	protocols := map[string]bool{"udp": true, "tcp": true, "tcp-tls": true, "https": true}
+	for _, l := range c.Listen {
+		if len(l.Net) == 0 {
+			return errors.Errorf("no protocol to listen on %s", l.Addr)
+		}
+		for _, network := range l.Net {
+			if !protocols[network] {
+				return errors.Errorf("unknown protocol %s to listen on %s", network, l.Addr)
+			}
+		}
+	}
+
+	switch c.BlockMode {
+	case "", "ip", "null", "nxdomain", "refused", "nodata":
+	default:
+		return errors.Errorf("unknown block mode %s", c.BlockMode)
+	}
+	if ip := net.ParseIP(c.Nullroute); c.Nullroute != "" && (ip == nil || ip.To4() == nil) {
+		return errors.Errorf("invalid nullroute %s", c.Nullroute)
+	}
+	if ip := net.ParseIP(c.Nullroutev6); c.Nullroutev6 != "" && ip == nil {
+		return errors.Errorf("invalid nullroutev6 %s", c.Nullroutev6)
+	}
+
+	builtin := map[string]bool{"nameservers": true, "chnameservers": true, "ispnameservers": true}
+	for name := range c.Upstreams {
+		if builtin[name] {
+			return errors.Errorf("upstream group %s conflicts with builtin group", name)
+		}
+	}
+	for _, ns := range configNameservers(c) {
+		if _, err := newUpstream(ns, c.Timeout.Duration); err != nil {
+			return err
+		}
+	}
+	for _, r := range c.Routes {
+		if _, ok := c.Upstreams[r.Upstream]; !ok && !builtin[r.Upstream] {
+			return errors.Errorf("unknown upstream group %s in routes", r.Upstream)
+		}
+	}
+	for _, g := range c.Groups {
+		if _, ok := c.Upstreams[g.Upstream]; g.Upstream != "" && !ok && !builtin[g.Upstream] {
+			return errors.Errorf("unknown upstream group %s in group %s", g.Upstream, g.Name)
+		}
+	}
+	if _, err := parseGroups(c); err != nil {
+		return err
+	}
+	if err := validateCategories(c); err != nil {
+		return err
+	}
+	if _, err := parseSchedules(c); err != nil {
+		return err
+	}
 
 	return nil
 }
 
+// configNameservers returns the nameservers of all groups of c, the builtin
+// ones and those of upstreams
+func configNameservers(c *config) []string {
+	var ns []string
+	ns = append(ns, c.Nameservers...)
+	ns = append(ns, c.CHNameservers...)
+	ns = append(ns, c.ISPNameservers...)
+	for _, nameservers := range c.Upstreams {
+		ns = append(ns, nameservers...)
+	}
+	return ns
+}
+
 func generateConfig(path string) error {
 	output, err := os.Create(path)
 	if err != nil {
@@ -0,0 +1,32 @@
+package dns
+
+import (
+	"testing"
+
+	"github.com/BurntSushi/toml"
+)
+
+func TestDefaultConfig(t *testing.T) {
+	var c config
+	if _, err := toml.Decode(defaultConfig, &c); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateConfig(&c); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateConfigRoutes(t *testing.T) {
+	c := config{
+		Upstreams: map[string][]string{"corp": {"10.0.0.53:53"}},
+		Routes:    []route{{Domains: []string{"corp.example.com"}, Upstream: "corp"}},
+	}
+	if err := validateConfig(&c); err != nil {
+		t.Error(err)
+	}
+
+	c.Routes = append(c.Routes, route{Domains: []string{"example.com"}, Upstream: "unknown"})
+	if err := validateConfig(&c); err == nil {
+		t.Error("route to unknown upstream group should be rejected")
+	}
+}
@@ -1,16 +1,20 @@
 package dns
 
 import (
-	"bufio"
 	"compress/gzip"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/oschwald/geoip2-golang"
 	"github.com/pkg/errors"
@@ -18,66 +22,45 @@ import (
 
 var gGeoIP *geoip2.Reader
 
-// LoadData loads the BlockCache
-func LoadData(forceupdate bool) error {
-	var err error
-	if _, err = os.Stat(gConfig.DataDir); os.IsNotExist(err) {
-		if err = os.Mkdir(gConfig.DataDir, os.ModePerm); err != nil {
-			return errors.Wrapf(err, "failed to create source directory: %s",
-				gConfig.DataDir)
-		}
-	}
+// LoadData loads the BlockCache and the GeoIP database, a source which
+// fails to download or load is reported and skipped. It is serialized with
+// reloads and list updates, which may start while sources are downloaded.
+func (s *Server) LoadData(forceupdate bool) error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
 
-	whitelist := make(map[string]bool)
-	for _, entry := range gConfig.Whitelist {
-		whitelist[entry] = true
+	blockCache := NewBlockList()
+	if err := loadBlocklists(getConfig(), blockCache, forceupdate, s.quit); err != nil {
+		return err
 	}
+	gBlockCache.Replace(blockCache)
 
-	for _, entry := range gConfig.Blocklist {
-		gBlockCache.Set(entry, true)
+	err := loadGeoIP(forceupdate, s.quit)
+	setLoaded("geoip", 0, 0, err)
+	if err != nil {
+		log.Printf("answers are not checked by country: %s\n", err)
 	}
 
-	log.Printf("loading blocked domains from %s\n", gConfig.DataDir)
-	for _, uri := range gConfig.EasyLists {
-		u, _ := url.Parse(uri)
-		fileName := fmt.Sprintf("%s%s", u.Host, strings.Replace(u.Path, "/", "-", -1))
-		path := filepath.Join(gConfig.DataDir, fileName)
-		if _, err = os.Stat(path); os.IsNotExist(err) || forceupdate {
-			log.Printf("fetching source %s\n", uri)
-			if err = downloadFile(uri, path); err != nil {
-				return err
-			}
-		}
-
-		if err = parseEasyList(path, whitelist); err != nil {
-			return err
-		}
-	}
-	log.Printf("%d domains loaded from easylist\n", gBlockCache.Length())
-	for _, uri := range gConfig.Sources {
-		u, _ := url.Parse(uri)
-		fileName := fmt.Sprintf("%s%s", u.Host, strings.Replace(u.Path, "/", "-", -1))
-		path := filepath.Join(gConfig.DataDir, fileName)
-		if _, err = os.Stat(path); os.IsNotExist(err) || forceupdate {
-			log.Printf("fetching source %s\n", uri)
-			if err = downloadFile(uri, path); err != nil {
-				return err
-			}
-		}
+	return nil
+}
 
-		if err = parseHostFile(path, whitelist); err != nil {
-			return err
-		}
-	}
-	log.Printf("%d domains loaded from easylist and host sources\n", gBlockCache.Length())
+// loadGeoIP loads the GeoIP database, which is downloaded when missing or
+// forceupdate is set, retries of the download stop when stop is closed
+func loadGeoIP(forceupdate bool, stop <-chan struct{}) error {
+	var err error
 
 	log.Println("loading GeoIP database")
-	dbPath := filepath.Join(gConfig.DataDir, gConfig.GeoIPName)
+	dbPath := filepath.Join(getConfig().DataDir, getConfig().GeoIPName)
 	if _, err = os.Stat(dbPath); os.IsNotExist(err) || forceupdate {
-		gzPath := filepath.Join(gConfig.DataDir, filepath.Base(gConfig.GeoIPSrc))
+		gzPath := filepath.Join(getConfig().DataDir, filepath.Base(getConfig().GeoIPSrc))
 		if _, err = os.Stat(gzPath); os.IsNotExist(err) || forceupdate {
-			if err = downloadFile(gConfig.GeoIPSrc, gzPath); err != nil {
-				return err
+			_, err = downloadFile(getConfig().GeoIPSrc, gzPath, stop)
+			setFetched("geoip", err)
+			if err != nil {
+				if _, serr := os.Stat(gzPath); serr != nil {
+					return err
+				}
+				log.Printf("%s, using the last good copy\n", err)
 			}
 		}
 
@@ -93,17 +76,24 @@ func LoadData(forceupdate bool) error {
 		}
 		defer gz.Close()
 
-		path := filepath.Join(gConfig.DataDir, gConfig.GeoIPName)
-		fw, err := os.Create(path)
+		// the database is replaced only after it is completely written
+		tmp := dbPath + ".tmp"
+		fw, err := os.Create(tmp)
 		if err != nil {
 			return errors.Wrap(err, "failed to create GeoIP file")
 		}
-		defer fw.Close()
 
 		_, err = io.Copy(fw, gz)
+		if cerr := fw.Close(); err == nil {
+			err = cerr
+		}
 		if err != nil {
+			os.Remove(tmp)
 			return errors.Wrap(err, "failed to write GeoIP file")
 		}
+		if err = os.Rename(tmp, dbPath); err != nil {
+			return errors.Wrap(err, "failed to replace GeoIP file")
+		}
 	}
 
 	if gGeoIP, err = geoip2.Open(dbPath); err != nil {
@@ -114,82 +104,402 @@ func LoadData(forceupdate bool) error {
 	return nil
 }
 
-func downloadFile(uri string, path string) error {
-	output, err := os.Create(path)
-	if err != nil {
-		return errors.Wrapf(err, "failed to create file: %s", path)
+// loadBlocklists fills cache with the blocklist entries and sources of c,
+// sources are only downloaded when missing or forceupdate is set, retries of
+// downloads stop when stop is closed
+func loadBlocklists(c *config, cache *BlockList, forceupdate bool, stop <-chan struct{}) error {
+	var err error
+	if _, err = os.Stat(c.DataDir); os.IsNotExist(err) {
+		if err = os.Mkdir(c.DataDir, os.ModePerm); err != nil {
+			return errors.Wrapf(err, "failed to create source directory: %s",
+				c.DataDir)
+		}
 	}
-	defer output.Close()
 
-	response, err := http.Get(uri)
-	if response != nil {
-		defer response.Body.Close()
+	// whitelist and blocklist entries are filter rules too, a plain domain
+	// in the whitelist is an exception for the domain and its subdomains
+	for i, entry := range c.Whitelist {
+		if !strings.HasPrefix(entry, "@@") {
+			entry = "@@" + entry
+		}
+		if err = cache.AddRule(entry, "whitelist", i+1); err != nil {
+			log.Printf("invalid whitelist entry %s: %s\n", entry, err)
+		}
 	}
-	if err != nil {
-		return errors.Wrapf(err, "failed to download source: %s", uri)
+	for i, entry := range c.Blocklist {
+		if err = cache.AddRule(entry, "blocklist", i+1); err != nil {
+			log.Printf("invalid blocklist entry %s: %s\n", entry, err)
+		}
+	}
+	// those of a group only apply to its clients
+	for _, g := range c.Groups {
+		for i, entry := range g.Whitelist {
+			if !strings.HasPrefix(entry, "@@") {
+				entry = "@@" + entry
+			}
+			if err = cache.AddRule(entry, groupSource+g.Name+":whitelist", i+1); err != nil {
+				log.Printf("invalid whitelist entry %s of group %s: %s\n", entry, g.Name, err)
+			}
+		}
+		for i, entry := range g.Blocklist {
+			if err = cache.AddRule(entry, groupSource+g.Name+":blocklist", i+1); err != nil {
+				log.Printf("invalid blocklist entry %s of group %s: %s\n", entry, g.Name, err)
+			}
+		}
 	}
 
-	if _, err := io.Copy(output, response.Body); err != nil {
-		return errors.Wrap(err, "failed to copy output")
+	log.Printf("loading blocked domains from %s\n", c.DataDir)
+	for _, uri := range listURIs(c) {
+		path := listPath(c, uri)
+		if _, err = os.Stat(path); isRemote(uri) && (os.IsNotExist(err) || forceupdate) {
+			log.Printf("fetching source %s\n", uri)
+			_, err = downloadFile(uri, path, stop)
+			setFetched(uri, err)
+			if err != nil {
+				// the file of the last good download, if any, is loaded instead
+				log.Println(err)
+			}
+		}
+
+		parse := parseFilterList
+		if isRPZ(c, uri) {
+			parse = parseRPZ
+		}
+		added, skipped, err := parse(path, uri, categoryOf(c, uri), cache)
+		setLoaded(uri, added, skipped, err)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if skipped > 0 {
+			log.Printf("%d unsupported rules skipped in %s\n", skipped, uri)
+		}
 	}
+	stats := cache.Stats()
+	log.Printf("%d rules loaded from easylist and host sources, %d nodes in about %d KB\n",
+		stats.Rules, stats.Nodes, stats.Bytes/1024)
 
 	return nil
 }
 
-func parseHostFile(path string, whitelist map[string]bool) error {
-	file, err := os.Open(path)
-	if err != nil {
-		return errors.Wrapf(err, "failed to open host file: %s", path)
+// configURIs returns the easylists, sources and response policy zones of c
+func configURIs(c *config) []string {
+	var uris []string
+	uris = append(uris, c.EasyLists...)
+	uris = append(uris, c.Sources...)
+	uris = append(uris, c.RPZ...)
+	return uris
+}
+
+// listURIs returns the lists of c, which are those of configURIs followed by
+// the lists named by groups or categories alone
+func listURIs(c *config) []string {
+	uris := configURIs(c)
+	seen := make(map[string]bool)
+	for _, uri := range uris {
+		seen[uri] = true
+	}
+	for _, g := range c.Groups {
+		for _, uri := range g.Lists {
+			if !seen[uri] {
+				seen[uri] = true
+				uris = append(uris, uri)
+			}
+		}
+	}
+	categories := make([]string, 0, len(c.Categories))
+	for category := range c.Categories {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+	for _, category := range categories {
+		for _, uri := range c.Categories[category] {
+			if !seen[uri] {
+				seen[uri] = true
+				uris = append(uris, uri)
+			}
+		}
+	}
+	return uris
+}
+
+// isRemote reports whether uri is downloaded, rather than a local file
+func isRemote(uri string) bool {
+	return strings.HasPrefix(uri, "http://") || strings.HasPrefix(uri, "https://")
+}
+
+// isRPZ reports whether uri is a response policy zone of c
+func isRPZ(c *config, uri string) bool {
+	for _, rpz := range c.RPZ {
+		if rpz == uri {
+			return true
+		}
 	}
-	defer file.Close()
+	return false
+}
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line != "" && !strings.HasPrefix(line, "#") {
-			fields := strings.Fields(line)
+// listPath returns the file in datadir of a list downloaded from uri, or
+// uri itself for a local file
+func listPath(c *config, uri string) string {
+	if !isRemote(uri) {
+		return uri
+	}
+	u, _ := url.Parse(uri)
+	fileName := fmt.Sprintf("%s%s", u.Host, strings.Replace(u.Path, "/", "-", -1))
+	return filepath.Join(c.DataDir, fileName)
+}
 
-			if len(fields) > 1 && !strings.HasPrefix(fields[1], "#") {
-				line = fields[1]
-			} else {
-				line = fields[0]
-			}
+// UpdateData downloads the lists of the config again every interval until
+// Shutdown is called, the blocklist is rebuilt and swapped in when any changed
+func (s *Server) UpdateData(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 
-			if !gBlockCache.Exists(line) && !whitelist[line] {
-				gBlockCache.Set(line, true)
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.updateLists(); err != nil {
+				log.Printf("failed to update blocklists: %s\n", err)
 			}
+		case <-s.quit:
+			return
 		}
 	}
-	if err := scanner.Err(); err != nil {
-		return errors.Wrapf(err, "failed to scan hostfile: %s", path)
+}
+
+// updateLists downloads the lists which changed since their last download,
+// a list which fails to download keeps its previous file
+func (s *Server) updateLists() error {
+	// a reload rebuilds the blocklist too, with the config it swaps in
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	c := getConfig()
+	changed := false
+	for _, uri := range listURIs(c) {
+		if !isRemote(uri) {
+			continue
+		}
+		updated, err := downloadFile(uri, listPath(c, uri), s.quit)
+		setFetched(uri, err)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if updated {
+			log.Printf("source %s updated\n", uri)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	blockCache := NewBlockList()
+	if err := loadBlocklists(c, blockCache, false, s.quit); err != nil {
+		return err
 	}
+	gBlockCache.Replace(blockCache)
 
 	return nil
 }
 
-func parseEasyList(path string, whitelist map[string]bool) error {
-	file, err := os.Open(path)
+// SourceStatus reports the last download and load of a blocklist source
+type SourceStatus struct {
+	URI           string    `json:"uri"`
+	Fetched       time.Time `json:"fetched,omitempty"` // last successful download or check
+	DownloadError string    `json:"downloadError,omitempty"`
+	Loaded        time.Time `json:"loaded,omitempty"`
+	LoadError     string    `json:"loadError,omitempty"`
+	Rules         int       `json:"rules"`
+	Skipped       int       `json:"skipped"`
+	// Stale is set when the last download failed and a previous copy is used
+	Stale bool `json:"stale"`
+}
+
+var (
+	gSourceMu     sync.Mutex
+	gSourceStatus = make(map[string]*SourceStatus)
+)
+
+func sourceStatus(uri string) *SourceStatus {
+	status, ok := gSourceStatus[uri]
+	if !ok {
+		status = &SourceStatus{URI: uri}
+		gSourceStatus[uri] = status
+	}
+	return status
+}
+
+// setFetched records the result of a download of uri
+func setFetched(uri string, err error) {
+	gSourceMu.Lock()
+	defer gSourceMu.Unlock()
+
+	status := sourceStatus(uri)
 	if err != nil {
-		return errors.Wrapf(err, "failed to open easylist file: %s", path)
+		status.DownloadError = err.Error()
+	} else {
+		status.DownloadError = ""
+		status.Fetched = time.Now()
 	}
-	defer file.Close()
+	status.Stale = status.DownloadError != "" && status.LoadError == "" && !status.Loaded.IsZero()
+}
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" ||
-			!strings.HasPrefix(line, "||") || !strings.HasSuffix(line, "^") {
-			continue
+// setLoaded records the result of loading the file of uri
+func setLoaded(uri string, rules, skipped int, err error) {
+	gSourceMu.Lock()
+	defer gSourceMu.Unlock()
+
+	status := sourceStatus(uri)
+	status.Rules, status.Skipped = rules, skipped
+	if err != nil {
+		status.LoadError = err.Error()
+	} else {
+		status.LoadError = ""
+		status.Loaded = time.Now()
+	}
+	status.Stale = status.DownloadError != "" && status.LoadError == "" && !status.Loaded.IsZero()
+}
+
+// SourceStatuses returns the status of the sources of the current config
+// and of the GeoIP database
+func SourceStatuses() []SourceStatus {
+	gSourceMu.Lock()
+	defer gSourceMu.Unlock()
+
+	var statuses []SourceStatus
+	for _, uri := range append(listURIs(getConfig()), "geoip") {
+		if status, ok := gSourceStatus[uri]; ok {
+			statuses = append(statuses, *status)
 		}
+	}
+	return statuses
+}
 
-		domain := strings.TrimSuffix(strings.TrimPrefix(line, "||"), "^")
-		if !gBlockCache.Exists(domain) && !whitelist[domain] {
-			gBlockCache.Set(domain, true)
+// downloads are attempted downloadRetries times, waiting downloadBackoff
+// before the first retry and twice as long before each next one, each
+// attempt is limited to the configured downloadTimeout, or to
+// defaultDownloadTimeout when it is not set
+var (
+	downloadRetries        = 3
+	downloadBackoff        = 2 * time.Second
+	defaultDownloadTimeout = 2 * time.Minute
+)
+
+// downloadError is a failed download, which is retried if temporary
+type downloadError struct {
+	error
+	temporary bool
+}
+
+// downloadMeta holds the validators of a downloaded file, which are saved
+// next to it for conditional requests
+type downloadMeta struct {
+	ETag         string `json:"etag"`
+	LastModified string `json:"lastModified"`
+}
+
+// downloadFile downloads uri to path unless path is up to date, as told by
+// the server on a conditional request, and returns whether path changed.
+// Network and server errors are retried with backoff, until stop is closed.
+// The file is replaced only after a complete download, so a failure leaves
+// the last good copy.
+func downloadFile(uri string, path string, stop <-chan struct{}) (bool, error) {
+	backoff := downloadBackoff
+	for attempt := 1; ; attempt++ {
+		changed, err := tryDownloadFile(uri, path)
+		derr, ok := err.(downloadError)
+		if err == nil || !ok || !derr.temporary || attempt >= downloadRetries {
+			return changed, err
+		}
+		log.Printf("%s, retrying in %s\n", err, backoff)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-stop:
+			timer.Stop()
+			return changed, err
+		}
+		backoff *= 2
+	}
+}
+
+// tryDownloadFile makes one attempt of downloadFile
+func tryDownloadFile(uri string, path string) (bool, error) {
+	var meta downloadMeta
+	metaPath := path + ".meta"
+	if _, err := os.Stat(path); err == nil {
+		if data, err := ioutil.ReadFile(metaPath); err == nil {
+			json.Unmarshal(data, &meta)
 		}
 	}
-	if err := scanner.Err(); err != nil {
-		return errors.Wrapf(err, "failed to scan easylist: %s", path)
+
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return false, errors.Wrapf(err, "invalid source: %s", uri)
+	}
+	if meta.ETag != "" {
+		req.Header.Set("If-None-Match", meta.ETag)
+	}
+	if meta.LastModified != "" {
+		req.Header.Set("If-Modified-Since", meta.LastModified)
 	}
 
-	return nil
+	timeout := getConfig().DownloadTimeout.Duration
+	if timeout <= 0 {
+		timeout = defaultDownloadTimeout
+	}
+	client := &http.Client{Timeout: timeout}
+	response, err := client.Do(req)
+	if err != nil {
+		return false, downloadError{errors.Wrapf(err, "failed to download source: %s", uri), true}
+	}
+	defer response.Body.Close()
+
+	switch {
+	case response.StatusCode == http.StatusOK:
+	case response.StatusCode == http.StatusNotModified:
+		return false, nil
+	default:
+		// client errors such as 404 won't go away by retrying
+		temporary := response.StatusCode >= 500 || response.StatusCode == http.StatusTooManyRequests
+		return false, downloadError{errors.Errorf("failed to download source: %s: %s", uri, response.Status), temporary}
+	}
+	// error and captive portal pages are served as html, lists never are
+	if strings.HasPrefix(response.Header.Get("Content-Type"), "text/html") {
+		return false, downloadError{errors.Errorf("failed to download source: %s: got an html page", uri), false}
+	}
+
+	tmp := path + ".tmp"
+	output, err := os.Create(tmp)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to create file: %s", tmp)
+	}
+	if _, err := io.Copy(output, response.Body); err != nil {
+		output.Close()
+		os.Remove(tmp)
+		return false, downloadError{errors.Wrapf(err, "failed to download source: %s", uri), true}
+	}
+	if err := output.Close(); err != nil {
+		os.Remove(tmp)
+		return false, errors.Wrapf(err, "failed to write file: %s", tmp)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return false, errors.Wrapf(err, "failed to replace file: %s", path)
+	}
+
+	meta = downloadMeta{response.Header.Get("ETag"), response.Header.Get("Last-Modified")}
+	if data, err := json.Marshal(meta); err == nil {
+		if err := ioutil.WriteFile(metaPath, data, 0644); err != nil {
+			log.Printf("failed to save validators of %s: %s\n", path, err)
+		}
+	}
+
+	return true, nil
 }
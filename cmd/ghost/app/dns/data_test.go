@@ -0,0 +1,205 @@
+package dns
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDownloadFile(t *testing.T) {
+	defer func(backoff time.Duration) { downloadBackoff = backoff }(downloadBackoff)
+	downloadBackoff = time.Millisecond
+
+	content, etag, fail := "||ads.example.com^\n", `"v1"`, false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Write([]byte(content))
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "ghost-download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "list.txt")
+
+	check := func(changed, expected bool, err error, data string) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if changed != expected {
+			t.Errorf("expected changed %v, got %v", expected, changed)
+		}
+		if b, _ := ioutil.ReadFile(path); string(b) != data {
+			t.Errorf("expected %q, got %q", data, b)
+		}
+	}
+
+	changed, err := downloadFile(srv.URL, path, nil)
+	check(changed, true, err, content)
+
+	changed, err = downloadFile(srv.URL, path, nil)
+	check(changed, false, err, content)
+
+	content, etag = "||tracker.example.com^\n", `"v2"`
+	changed, err = downloadFile(srv.URL, path, nil)
+	check(changed, true, err, content)
+
+	// a failed download keeps the previous file
+	fail = true
+	if _, err = downloadFile(srv.URL, path, nil); err == nil {
+		t.Error("expected an error for a failed download")
+	}
+	check(false, false, nil, content)
+
+	// the backoff between retries ends when stop is closed
+	downloadBackoff = time.Minute
+	stop := make(chan struct{})
+	close(stop)
+	start := time.Now()
+	if _, err = downloadFile(srv.URL, path, stop); err == nil {
+		t.Error("expected an error for a stopped download")
+	}
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("stopped download kept retrying for %s", elapsed)
+	}
+	downloadBackoff = time.Millisecond
+
+	// a server which never answers times out, and is retried
+	defer setConfig(getConfig())
+	setConfig(&config{DownloadTimeout: duration{50 * time.Millisecond}})
+	var attempts int32
+	hang := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		<-hang
+	}))
+	defer slow.Close()
+	defer close(hang)
+	if _, err = downloadFile(slow.URL, path, nil); err == nil {
+		t.Error("expected an error for a hanging download")
+	}
+	if attempts := int(atomic.LoadInt32(&attempts)); attempts != downloadRetries {
+		t.Errorf("expected %d attempts, got %d", downloadRetries, attempts)
+	}
+	check(false, false, nil, content)
+}
+
+func TestUpdateLists(t *testing.T) {
+	defer setConfig(getConfig())
+	saved := NewBlockList()
+	saved.Replace(gBlockCache)
+	defer gBlockCache.Replace(saved)
+
+	content := "||ads.example.com^\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(content))
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "ghost-update")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	setConfig(&config{DataDir: dir, EasyLists: []string{srv.URL + "/list.txt"}})
+	if err := loadBlocklists(getConfig(), gBlockCache, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !gBlockCache.Match("ads.example.com") {
+		t.Fatal("list was not loaded")
+	}
+
+	content = "||tracker.example.com^\n"
+	s := &Server{}
+	if err := s.updateLists(); err != nil {
+		t.Fatal(err)
+	}
+	if gBlockCache.Match("ads.example.com") || !gBlockCache.Match("tracker.example.com") {
+		t.Error("blocklist was not rebuilt from the updated list")
+	}
+}
+
+func TestLoadBlocklistsResilient(t *testing.T) {
+	defer func(backoff time.Duration) { downloadBackoff = backoff }(downloadBackoff)
+	downloadBackoff = time.Millisecond
+
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/good.txt":
+			w.Write([]byte("||ads.example.com^\n"))
+		case "/flaky.txt":
+			if attempts++; attempts < downloadRetries {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte("||flaky.example.com^\n"))
+		case "/portal.txt":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html>login</html>"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "ghost-load")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := &config{DataDir: dir, Sources: []string{
+		srv.URL + "/good.txt", srv.URL + "/dead.txt", srv.URL + "/flaky.txt", srv.URL + "/portal.txt",
+	}}
+	defer setConfig(getConfig())
+	setConfig(c)
+
+	// a previous copy of the portal list is used when its download fails
+	ioutil.WriteFile(listPath(c, srv.URL+"/portal.txt"), []byte("||portal.example.com^\n"), 0644)
+	setLoaded(srv.URL+"/portal.txt", 1, 0, nil)
+
+	b := NewBlockList()
+	if err := loadBlocklists(c, b, true, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"ads.example.com", "flaky.example.com", "portal.example.com"} {
+		if !b.Match(name) {
+			t.Errorf("%s was not loaded", name)
+		}
+	}
+	if attempts != downloadRetries {
+		t.Errorf("expected %d attempts of the flaky source, got %d", downloadRetries, attempts)
+	}
+
+	statuses := make(map[string]SourceStatus)
+	for _, status := range SourceStatuses() {
+		statuses[status.URI] = status
+	}
+	if s := statuses[srv.URL+"/good.txt"]; s.Rules != 1 || s.DownloadError != "" || s.LoadError != "" || s.Stale {
+		t.Errorf("unexpected status of good source %+v", s)
+	}
+	if s := statuses[srv.URL+"/dead.txt"]; s.DownloadError == "" || s.LoadError == "" || s.Stale {
+		t.Errorf("unexpected status of dead source %+v", s)
+	}
+	if s := statuses[srv.URL+"/portal.txt"]; s.DownloadError == "" || !s.Stale || s.Rules != 1 {
+		t.Errorf("unexpected status of portal source %+v", s)
+	}
+}
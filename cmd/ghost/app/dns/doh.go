@@ -0,0 +1,214 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// dnsMessageType is the media type of DNS over HTTPS, RFC 8484
+const dnsMessageType = "application/dns-message"
+
+// dohUpstream is a DNS over HTTPS nameserver. Queries are sent with POST,
+// unless the address ends with the "{?dns}" URI template, then GET is used.
+type dohUpstream struct {
+	url    string
+	get    bool
+	client *http.Client
+}
+
+func newDoHUpstream(addr string, timeout time.Duration) (*dohUpstream, error) {
+	get := strings.HasSuffix(addr, "{?dns}")
+	rawurl := strings.TrimSuffix(addr, "{?dns}")
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Host == "" {
+		return nil, errors.Errorf("invalid DNS over HTTPS nameserver: %s", addr)
+	}
+
+	// connections are kept alive between lookups of the same upstream
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: timeout,
+	}
+	return &dohUpstream{
+		url:    rawurl,
+		get:    get,
+		client: &http.Client{Transport: transport, Timeout: timeout},
+	}, nil
+}
+
+// Exchange implements upstream, net is ignored
+func (u *dohUpstream) Exchange(net string, req *dns.Msg) (*dns.Msg, time.Duration, error) {
+	// RFC 8484 recommends Id 0 to be cache friendly, req may be shared so copy it
+	m := req.Copy()
+	m.Id = 0
+	wire, err := m.Pack()
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "failed to pack query")
+	}
+
+	var hreq *http.Request
+	if u.get {
+		q := base64.RawURLEncoding.EncodeToString(wire)
+		hreq, err = http.NewRequest(http.MethodGet, u.url+"?dns="+q, nil)
+	} else {
+		hreq, err = http.NewRequest(http.MethodPost, u.url, bytes.NewReader(wire))
+		if hreq != nil {
+			hreq.Header.Set("Content-Type", dnsMessageType)
+		}
+	}
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "failed to create request for %s", u.url)
+	}
+	hreq.Header.Set("Accept", dnsMessageType)
+
+	start := time.Now()
+	resp, err := u.client.Do(hreq)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "failed to query %s", u.url)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("%s returned http status %s", u.url, resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, dnsMessageType) {
+		return nil, 0, fmt.Errorf("%s returned content type %s", u.url, ct)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "failed to read answer from %s", u.url)
+	}
+	rtt := time.Since(start)
+
+	r := new(dns.Msg)
+	if err := r.Unpack(body); err != nil {
+		return nil, 0, errors.Wrapf(err, "failed to unpack answer from %s", u.url)
+	}
+	r.Id = req.Id
+
+	return r, rtt, nil
+}
+
+// Close implements upstream, idle connections are closed
+func (u *dohUpstream) Close() {
+	u.client.CloseIdleConnections()
+}
+
+// dohWriter is a dns.ResponseWriter which keeps the reply for an HTTP response
+type dohWriter struct {
+	local  net.Addr
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+// LocalAddr implements dns.ResponseWriter
+func (w *dohWriter) LocalAddr() net.Addr { return w.local }
+
+// RemoteAddr implements dns.ResponseWriter
+func (w *dohWriter) RemoteAddr() net.Addr { return w.remote }
+
+// WriteMsg implements dns.ResponseWriter
+func (w *dohWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+// Write implements dns.ResponseWriter
+func (w *dohWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.msg = m
+	return len(b), nil
+}
+
+// Close implements dns.ResponseWriter
+func (w *dohWriter) Close() error { return nil }
+
+// TsigStatus implements dns.ResponseWriter
+func (w *dohWriter) TsigStatus() error { return nil }
+
+// TsigTimersOnly implements dns.ResponseWriter
+func (w *dohWriter) TsigTimersOnly(bool) {}
+
+// Hijack implements dns.ResponseWriter
+func (w *dohWriter) Hijack() {}
+
+// ServeHTTP answers DNS over HTTPS queries (RFC 8484, GET and POST)
+func (h *DNSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var wire []byte
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		q := strings.TrimRight(r.URL.Query().Get("dns"), "=")
+		wire, err = base64.RawURLEncoding.DecodeString(q)
+	case http.MethodPost:
+		if ct := r.Header.Get("Content-Type"); ct != dnsMessageType {
+			http.Error(w, "unsupported content type "+ct, http.StatusUnsupportedMediaType)
+			return
+		}
+		wire, err = ioutil.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, "invalid dns message", http.StatusBadRequest)
+		return
+	}
+
+	req := new(dns.Msg)
+	if err := req.Unpack(wire); err != nil || len(req.Question) == 0 {
+		http.Error(w, "invalid dns message", http.StatusBadRequest)
+		return
+	}
+
+	dw := &dohWriter{local: httpAddr(r.Host), remote: httpAddr(r.RemoteAddr)}
+	h.begin()
+	h.track("https", dw, req)
+	if dw.msg == nil {
+		http.Error(w, "no answer", http.StatusBadGateway)
+		return
+	}
+
+	out, err := dw.msg.Pack()
+	if err != nil {
+		log.Printf("failed to pack DNS over HTTPS answer: %s\n", err)
+		http.Error(w, "invalid answer", http.StatusInternalServerError)
+		return
+	}
+
+	// the answer can be cached by http caches as long as its smallest TTL
+	if ttl, ok := msgTTL(dw.msg); ok {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", ttl))
+	}
+	w.Header().Set("Content-Type", dnsMessageType)
+	w.Write(out)
+}
+
+// httpAddr turns the host:port of an http request into a net.Addr
+func httpAddr(hostport string) net.Addr {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	p, _ := strconv.Atoi(port)
+	return &net.TCPAddr{IP: net.ParseIP(host), Port: p}
+}
@@ -0,0 +1,155 @@
+package dns
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dohStandIn answers A queries with 127.0.0.1 over DNS over HTTPS
+func dohStandIn(t *testing.T, method string) *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			t.Errorf("expected %s request, got %s", method, r.Method)
+		}
+
+		var wire []byte
+		var err error
+		if r.Method == http.MethodGet {
+			wire, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		} else {
+			wire, err = ioutil.ReadAll(r.Body)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		req := new(dns.Msg)
+		if err := req.Unpack(wire); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Id != 0 {
+			t.Errorf("expected query Id 0, got %d", req.Id)
+		}
+
+		m := new(dns.Msg)
+		m.SetReply(req)
+		rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 127.0.0.1")
+		m.Answer = append(m.Answer, rr)
+		out, _ := m.Pack()
+		w.Header().Set("Content-Type", dnsMessageType)
+		w.Write(out)
+	}))
+}
+
+func TestDoHUpstream(t *testing.T) {
+	for _, c := range []struct {
+		method string
+		suffix string
+	}{
+		{http.MethodPost, ""},
+		{http.MethodGet, "{?dns}"},
+	} {
+		srv := dohStandIn(t, c.method)
+
+		u, err := newUpstream(srv.URL+"/dns-query"+c.suffix, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		doh := u.(*dohUpstream)
+		doh.client = srv.Client()
+
+		req := new(dns.Msg)
+		req.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
+		m, _, err := doh.Exchange("udp", req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Id != req.Id {
+			t.Errorf("expected Id %d, got %d", req.Id, m.Id)
+		}
+		if len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "127.0.0.1" {
+			t.Errorf("unexpected answer %v", m.Answer)
+		}
+
+		srv.Close()
+	}
+}
+
+func TestNewUpstream(t *testing.T) {
+	for _, addr := range []string{"8.8.8.8:53", "[2001:4860:4860::8888]:53", "https://1.1.1.1/dns-query"} {
+		if _, err := newUpstream(addr, time.Second); err != nil {
+			t.Errorf("%s: %s", addr, err)
+		}
+	}
+	for _, addr := range []string{"8.8.8.8", "https:///dns-query"} {
+		if _, err := newUpstream(addr, time.Second); err == nil {
+			t.Errorf("%s should be invalid", addr)
+		}
+	}
+}
+
+func TestDoHServer(t *testing.T) {
+	h := NewHandler()
+	defer h.Close()
+
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
+	rr, _ := dns.NewRR(dns.Fqdn(testDomain) + " 60 IN A 127.0.0.1")
+	m.Answer = append(m.Answer, rr)
+	h.cache.Set(testDomain+" IN A", m, false)
+
+	srv := httptest.NewTLSServer(h)
+	defer srv.Close()
+
+	for _, suffix := range []string{"", "{?dns}"} {
+		u, err := newUpstream(srv.URL+"/dns-query"+suffix, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		doh := u.(*dohUpstream)
+		doh.client = srv.Client()
+
+		req := new(dns.Msg)
+		req.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
+		r, _, err := doh.Exchange("udp", req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "127.0.0.1" {
+			t.Errorf("unexpected answer %v", r.Answer)
+		}
+	}
+
+	// blocked queries are logged with the http client address
+	const blocked = "blocked.example.com"
+	gBlockCache.AddRule("|"+blocked+"^", "test", 1)
+	defer gBlockCache.Remove(blocked)
+	doh := &dohUpstream{url: srv.URL + "/dns-query", client: srv.Client()}
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(blocked), dns.TypeA)
+	if _, _, err := doh.Exchange("udp", req); err != nil {
+		t.Fatal(err)
+	}
+	entries := gQuestionCache.Backend
+	if len(entries) == 0 || entries[len(entries)-1].Remote != "127.0.0.1" ||
+		entries[len(entries)-1].Query.Qnet != "https" {
+		t.Errorf("query from http client not logged: %v", entries)
+	}
+
+	resp, err := srv.Client().Get(srv.URL + "/dns-query?dns=invalid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status 400 for invalid query, got %s", resp.Status)
+	}
+}
@@ -0,0 +1,282 @@
+package dns
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+const (
+	// dotPoolSize is the number of connections kept to each DoT nameserver
+	dotPoolSize = 2
+	// dotPort is the default port of DNS over TLS, RFC 7858
+	dotPort = "853"
+	// dotMaxTimeouts is the number of timeouts in a row after which a
+	// connection is taken for half-open, and closed
+	dotMaxTimeouts = 2
+)
+
+// ErrConnClosed is returned for queries pending on a closed DoT connection
+var ErrConnClosed = errors.New("connection closed")
+
+// dotUpstream is a DNS over TLS nameserver, written as
+// tls://ip:port?pin=base64(sha256(spki))#servername. Queries are pipelined
+// on a small pool of persistent connections.
+type dotUpstream struct {
+	addr      string
+	tlsConfig *tls.Config
+	timeout   time.Duration
+
+	mu     sync.Mutex
+	conns  [dotPoolSize]*dotConn
+	next   int
+	closed bool
+}
+
+func newDoTUpstream(addr string, timeout time.Duration) (*dotUpstream, error) {
+	u, err := url.Parse(addr)
+	if err != nil || u.Host == "" {
+		return nil, errors.Errorf("invalid DNS over TLS nameserver: %s", addr)
+	}
+
+	host := u.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, dotPort)
+	}
+	serverName := u.Fragment
+	if serverName == "" {
+		serverName, _, _ = net.SplitHostPort(host)
+	}
+
+	// pins are standard base64, which must not be query unescaped ('+')
+	var pins [][]byte
+	for _, kv := range strings.Split(u.RawQuery, "&") {
+		if !strings.HasPrefix(kv, "pin=") {
+			continue
+		}
+		pin := strings.TrimPrefix(kv, "pin=")
+		digest, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(digest) != sha256.Size {
+			return nil, errors.Errorf("invalid pin %s of nameserver: %s", pin, addr)
+		}
+		pins = append(pins, digest)
+	}
+
+	tlsConfig := &tls.Config{ServerName: serverName}
+	if len(pins) > 0 {
+		tlsConfig.VerifyPeerCertificate = verifyPins(pins)
+	}
+
+	return &dotUpstream{addr: host, tlsConfig: tlsConfig, timeout: timeout}, nil
+}
+
+// verifyPins accepts a verified certificate chain only if one of its
+// certificates has a public key matching one of pins
+func verifyPins(pins [][]byte) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+		for _, chain := range chains {
+			for _, cert := range chain {
+				digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				for _, pin := range pins {
+					if bytes.Equal(digest[:], pin) {
+						return nil
+					}
+				}
+			}
+		}
+		return errors.New("no certificate matches the pinned public keys")
+	}
+}
+
+// Exchange implements upstream, net is ignored
+func (u *dotUpstream) Exchange(net string, req *dns.Msg) (*dns.Msg, time.Duration, error) {
+	c, reused, err := u.conn()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	r, rtt, err := c.Exchange(req, u.timeout)
+	if err == ErrConnClosed && reused {
+		// the server may close idle connections, retry once on a new one
+		if c, _, err = u.conn(); err != nil {
+			return nil, 0, err
+		}
+		r, rtt, err = c.Exchange(req, u.timeout)
+	}
+	return r, rtt, err
+}
+
+// conn returns the next connection of the pool, dialing it if needed, other
+// exchanges keep using the pool while it is dialed
+func (u *dotUpstream) conn() (*dotConn, bool, error) {
+	u.mu.Lock()
+	if u.closed {
+		u.mu.Unlock()
+		return nil, false, ErrConnClosed
+	}
+	i := u.next
+	u.next = (u.next + 1) % dotPoolSize
+	if c := u.conns[i]; c != nil && !c.Closed() {
+		u.mu.Unlock()
+		return c, true, nil
+	}
+	u.mu.Unlock()
+
+	dialer := &net.Dialer{Timeout: u.timeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", u.addr, u.tlsConfig)
+	if err != nil {
+		return nil, false, errors.Wrapf(err, "failed to connect %s", u.addr)
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.closed {
+		conn.Close()
+		return nil, false, ErrConnClosed
+	}
+	if c := u.conns[i]; c != nil && !c.Closed() {
+		// dialed by another exchange meanwhile
+		conn.Close()
+		return c, false, nil
+	}
+	c := newDoTConn(conn)
+	u.conns[i] = c
+	return c, false, nil
+}
+
+// Close implements upstream, the connections of the pool are closed and no
+// new one is dialed
+func (u *dotUpstream) Close() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.closed = true
+	for i, c := range u.conns {
+		if c != nil {
+			c.close()
+			u.conns[i] = nil
+		}
+	}
+}
+
+// dotConn is a DNS over TLS connection which carries concurrent queries,
+// answers are matched to queries by Id
+type dotConn struct {
+	conn *dns.Conn
+
+	mu       sync.Mutex
+	pending  map[uint16]chan *dns.Msg
+	timeouts int // timeouts since the last answer
+	closed   bool
+}
+
+func newDoTConn(conn net.Conn) *dotConn {
+	c := &dotConn{
+		conn:    &dns.Conn{Conn: conn},
+		pending: make(map[uint16]chan *dns.Msg),
+	}
+	go c.readLoop()
+	return c
+}
+
+// Exchange sends req and waits timeout for its answer
+func (c *dotConn) Exchange(req *dns.Msg, timeout time.Duration) (*dns.Msg, time.Duration, error) {
+	// the Id of req may collide with other queries on this connection
+	m := req.Copy()
+	res := make(chan *dns.Msg, 1)
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, 0, ErrConnClosed
+	}
+	for {
+		m.Id = dns.Id()
+		if _, ok := c.pending[m.Id]; !ok {
+			break
+		}
+	}
+	c.pending[m.Id] = res
+	start := time.Now()
+	c.conn.SetWriteDeadline(start.Add(timeout))
+	err := c.conn.WriteMsg(m)
+	c.mu.Unlock()
+	if err != nil {
+		c.close()
+		return nil, 0, ErrConnClosed
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r, ok := <-res:
+		if !ok {
+			return nil, 0, ErrConnClosed
+		}
+		r.Id = req.Id
+		return r, time.Since(start), nil
+	case <-timer.C:
+		c.mu.Lock()
+		delete(c.pending, m.Id)
+		c.timeouts++
+		halfOpen := c.timeouts >= dotMaxTimeouts
+		c.mu.Unlock()
+		if halfOpen {
+			// a connection dropped on the way keeps timing out until the
+			// kernel notices, the next exchange dials a new one
+			c.close()
+		}
+		return nil, 0, errors.Errorf("read answer from %s timeout", c.conn.RemoteAddr())
+	}
+}
+
+// Closed reports whether the connection can no longer be used
+func (c *dotConn) Closed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+func (c *dotConn) readLoop() {
+	defer c.close()
+	for {
+		r, err := c.conn.ReadMsg()
+		if err != nil {
+			return
+		}
+
+		c.mu.Lock()
+		res, ok := c.pending[r.Id]
+		delete(c.pending, r.Id)
+		c.timeouts = 0
+		c.mu.Unlock()
+		if ok {
+			res <- r
+		}
+	}
+}
+
+// close closes the connection and fails all pending queries
+func (c *dotConn) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	c.conn.Close()
+	for id, res := range c.pending {
+		close(res)
+		delete(c.pending, id)
+	}
+}
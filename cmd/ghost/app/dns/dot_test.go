@@ -0,0 +1,239 @@
+package dns
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dotStandIn starts a DNS over TLS server answering A queries with
+// 127.0.0.1, using the certificate of an httptest server
+func dotStandIn(t *testing.T) (*dns.Server, *x509.Certificate) {
+	hs := httptest.NewTLSServer(nil)
+	hs.Close()
+	cert := hs.Certificate()
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: hs.TLS.Certificates})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 127.0.0.1")
+		m.Answer = append(m.Answer, rr)
+		w.WriteMsg(m)
+	})
+	srv := &dns.Server{Listener: l, Net: "tcp-tls", Handler: mux}
+	go srv.ActivateAndServe()
+
+	return srv, cert
+}
+
+func TestDoTUpstream(t *testing.T) {
+	srv, cert := dotStandIn(t)
+	defer srv.Shutdown()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	pin := base64.StdEncoding.EncodeToString(digest[:])
+	addr := "tls://" + srv.Listener.Addr().String()
+
+	u, err := newUpstream(addr+"?pin="+pin+"#example.com", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dot := u.(*dotUpstream)
+	dot.tlsConfig.RootCAs = roots
+
+	// concurrent queries are pipelined on the pooled connections
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := new(dns.Msg)
+			req.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
+			m, _, err := dot.Exchange("tcp", req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if m.Id != req.Id {
+				t.Errorf("expected Id %d, got %d", req.Id, m.Id)
+			}
+			if len(m.Answer) != 1 {
+				t.Errorf("unexpected answer %v", m.Answer)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// a wrong pin is rejected
+	wrong := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+	u, err = newUpstream(addr+"?pin="+wrong+"#example.com", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dot = u.(*dotUpstream)
+	dot.tlsConfig.RootCAs = roots
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
+	if _, _, err := dot.Exchange("tcp", req); err == nil {
+		t.Error("exchange should fail with a wrong pin")
+	}
+}
+
+func TestDoTConnTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	// the server reads queries and never answers
+	go io.Copy(ioutil.Discard, server)
+
+	c := newDoTConn(client)
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
+	for i := 1; i <= dotMaxTimeouts; i++ {
+		if _, _, err := c.Exchange(req, 20*time.Millisecond); err == nil {
+			t.Fatal("exchange should time out")
+		}
+		if closed := c.Closed(); closed != (i == dotMaxTimeouts) {
+			t.Errorf("after %d timeouts: expected closed %v, got %v", i, i == dotMaxTimeouts, closed)
+		}
+	}
+}
+
+func TestUpstreamPoolPrune(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go io.Copy(ioutil.Discard, server)
+
+	dot, err := newDoTUpstream("tls://192.0.2.1", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newDoTConn(client)
+	dot.conns[0] = c
+
+	var p upstreamPool
+	if _, err := p.Get("192.0.2.2:53"); err != nil {
+		t.Fatal(err)
+	}
+	p.upstreams["tls://192.0.2.1"] = dot
+
+	p.Prune([]string{"192.0.2.2:53"})
+	if _, ok := p.upstreams["tls://192.0.2.1"]; ok || len(p.upstreams) != 1 {
+		t.Errorf("unexpected upstreams after prune: %v", p.upstreams)
+	}
+	if !c.Closed() {
+		t.Error("connection of a removed upstream was not closed")
+	}
+	if _, _, err := dot.conn(); err != ErrConnClosed {
+		t.Errorf("closed upstream should not dial, got %v", err)
+	}
+}
+
+func TestNewDoTUpstream(t *testing.T) {
+	u, err := newDoTUpstream("tls://1.1.1.1#cloudflare-dns.com", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.addr != "1.1.1.1:853" || u.tlsConfig.ServerName != "cloudflare-dns.com" {
+		t.Errorf("unexpected upstream %s %s", u.addr, u.tlsConfig.ServerName)
+	}
+
+	if _, err := newDoTUpstream("tls://1.1.1.1:853?pin=short#cloudflare-dns.com", time.Second); err == nil {
+		t.Error("invalid pin should be rejected")
+	}
+}
+
+func TestDoTServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a self-signed certificate is generated
+	tlsConfig, err := loadTLSConfig(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := NewHandler()
+	defer h.Close()
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", h.DoTLS)
+	srv := &dns.Server{Listener: l, Net: "tcp-tls", Handler: mux}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+
+	defer setConfig(getConfig())
+	setConfig(&config{Nullroute: "0.0.0.0"})
+
+	const blocked = "blocked.example.com"
+	gBlockCache.AddRule("|"+blocked+"^", "test", 1)
+	defer gBlockCache.Remove(blocked)
+
+	cert, _ := x509.ParseCertificate(tlsConfig.Certificates[0].Certificate[0])
+	digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	pin := base64.StdEncoding.EncodeToString(digest[:])
+	u, err := newUpstream("tls://"+l.Addr().String()+"?pin="+pin+"#localhost", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dot := u.(*dotUpstream)
+	dot.tlsConfig.RootCAs = x509.NewCertPool()
+	dot.tlsConfig.RootCAs.AddCert(cert)
+
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(blocked), dns.TypeA)
+	m, _, err := dot.Exchange("tcp", req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Answer) != 1 {
+		t.Errorf("expected blocked answer, got %v", m.Answer)
+	}
+
+	// clients send several queries over one connection
+	client := &dns.Client{Net: "tcp-tls", TLSConfig: &tls.Config{RootCAs: dot.tlsConfig.RootCAs, ServerName: "localhost"}}
+	conn, err := client.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for i := 0; i < 3; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion(dns.Fqdn(blocked), dns.TypeA)
+		if err := conn.WriteMsg(req); err != nil {
+			t.Fatalf("query %d: %s", i, err)
+		}
+		m, err := conn.ReadMsg()
+		if err != nil {
+			t.Fatalf("query %d: %s", i, err)
+		}
+		if m.Id != req.Id || len(m.Answer) != 1 {
+			t.Errorf("query %d: unexpected answer %v", i, m)
+		}
+	}
+}
@@ -9,10 +9,11 @@ import (
 	"github.com/miekg/dns"
 )
 
-func UpdateFakeIP(nameserver string) {
+// UpdateFakeIP discovers fake ips from nameserver every FakeInterval until stop is closed
+func UpdateFakeIP(nameserver string, stop <-chan struct{}) {
 	c := &dns.Client{
-		ReadTimeout:  gConfig.Timeout.Duration,
-		WriteTimeout: gConfig.Timeout.Duration,
+		ReadTimeout:  getConfig().Timeout.Duration,
+		WriteTimeout: getConfig().Timeout.Duration,
 	}
 	m := &dns.Msg{
 		MsgHdr: dns.MsgHdr{
@@ -25,19 +26,39 @@ func UpdateFakeIP(nameserver string) {
 		Qclass: uint16(dns.ClassINET),
 	}
 
-	for _, ip := range gConfig.FakeIps {
+	tInterval := time.NewTicker(getConfig().FakeInterval.Duration)
+	defer tInterval.Stop()
+	for {
+		getFakeIP(c, m, nameserver)
+		select {
+		case <-stop:
+			return
+		case <-tInterval.C:
+		}
+	}
+}
+
+// seedFakeIPs adds the cold fake ips of c, and removes those of old, which
+// may be nil, that c no longer has
+func seedFakeIPs(old, c *config) {
+	if old != nil {
+		keep := make(map[string]bool)
+		for _, ip := range c.FakeIps {
+			keep[ip] = true
+		}
+		for _, ip := range old.FakeIps {
+			if !keep[ip] {
+				gFakeIPCache.Remove(ip)
+				log.Printf("remove cold fake ip:%s\n", ip)
+			}
+		}
+	}
+	for _, ip := range c.FakeIps {
 		if !gFakeIPCache.Exists(ip) {
 			gFakeIPCache.Set(ip, true)
 			log.Printf("add cold fake ip:%s\n", ip)
 		}
 	}
-
-	tInterval := time.NewTicker(gConfig.FakeInterval.Duration)
-	defer tInterval.Stop()
-	for {
-		getFakeIP(c, m, nameserver)
-		<-tInterval.C
-	}
 }
 
 func getFakeIP(c *dns.Client, m *dns.Msg, nameserver string) {
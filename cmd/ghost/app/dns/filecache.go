@@ -0,0 +1,118 @@
+package dns
+
+import (
+	"encoding/gob"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// PersistentCache is a Cache which survives restarts
+type PersistentCache interface {
+	Cache
+	Load() error
+	Save() error
+}
+
+// FileCache is a MemoryCache which is written to a snapshot file on shutdown
+// and loaded again on startup
+type FileCache struct {
+	*MemoryCache
+	Path string
+}
+
+// snapshotEntry is the on-disk form of a Mesg, with the message in wire format
+type snapshotEntry struct {
+	Key    string
+	Wire   []byte
+	Expire time.Time
+	Stored time.Time
+	Hits   uint64
+}
+
+// Load fills the cache with the entries from the snapshot file, a missing
+// file is not an error
+func (c *FileCache) Load() error {
+	f, err := os.Open(c.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to open cache snapshot: %s", c.Path)
+	}
+	defer f.Close()
+
+	var entries []snapshotEntry
+	if err := gob.NewDecoder(f).Decode(&entries); err != nil {
+		return errors.Wrapf(err, "failed to decode cache snapshot: %s", c.Path)
+	}
+
+	deadline := time.Now().Add(-c.StaleWindow)
+	loaded := 0
+	for _, e := range entries {
+		if e.Expire.Before(deadline) {
+			continue
+		}
+		msg := new(dns.Msg)
+		if err := msg.Unpack(e.Wire); err != nil {
+			log.Printf("failed to unpack cached %s: %s\n", e.Key, err)
+			continue
+		}
+		c.restore(e.Key, Mesg{Msg: msg, Expire: e.Expire, Stored: e.Stored, Hits: e.Hits})
+		loaded++
+	}
+	log.Printf("%d entries loaded from cache snapshot %s\n", loaded, c.Path)
+
+	return nil
+}
+
+// Save writes all unblocked entries to the snapshot file, least recently
+// used first, so that Load restores the same eviction order
+func (c *FileCache) Save() error {
+	var entries []snapshotEntry
+	c.mu.RLock()
+	if c.lru != nil {
+		for elem := c.lru.Back(); elem != nil; elem = elem.Prev() {
+			key := elem.Value.(string)
+			mesg := c.Backend[key]
+			if mesg.Msg == nil || mesg.Blocked {
+				continue
+			}
+			wire, err := mesg.Msg.Pack()
+			if err != nil {
+				log.Printf("failed to pack cached %s: %s\n", key, err)
+				continue
+			}
+			entries = append(entries, snapshotEntry{key, wire, mesg.Expire, mesg.Stored, mesg.Hits})
+		}
+	}
+	c.mu.RUnlock()
+
+	if err := os.MkdirAll(filepath.Dir(c.Path), os.ModePerm); err != nil {
+		return errors.Wrapf(err, "failed to create cache directory: %s", filepath.Dir(c.Path))
+	}
+
+	// write to a temporary file first, a crash must not leave a broken snapshot
+	tmp := c.Path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create cache snapshot: %s", tmp)
+	}
+	if err := gob.NewEncoder(f).Encode(entries); err != nil {
+		f.Close()
+		return errors.Wrapf(err, "failed to encode cache snapshot: %s", tmp)
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrapf(err, "failed to write cache snapshot: %s", tmp)
+	}
+	if err := os.Rename(tmp, c.Path); err != nil {
+		return errors.Wrapf(err, "failed to replace cache snapshot: %s", c.Path)
+	}
+	log.Printf("%d entries saved to cache snapshot %s\n", len(entries), c.Path)
+
+	return nil
+}
@@ -0,0 +1,296 @@
+package dns
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// BlockRule is a rule of a filter list, in the subset of the AdGuard DNS
+// filtering syntax below, or a hosts file line
+//
+//	||example.org^     example.org and its subdomains
+//	|example.org^      example.org only
+//	example.org        example.org and its subdomains
+//	ad*.example.org    names matching the wildcards
+//	/^ad[0-9]+\./      names matching the regular expression
+//	@@||example.org^   an exception, which allows names instead
+//	0.0.0.0 a.org b.org  a.org and b.org only
+//
+// with the modifiers $important, $client=, $dnstype= and $denyallow=. Rules
+// with other modifiers are meant for browsers and skipped.
+type BlockRule struct {
+	Source string `json:"source"`
+	Line   int    `json:"line"`
+	Text   string `json:"text"`
+	// Category is the category of the source, a rule with one only blocks
+	// while a schedule of its category is active
+	Category string `json:"category,omitempty"`
+
+	allow      bool
+	important  bool
+	name       string // domain of a trie rule
+	subdomains bool
+	subOnly    bool // subdomains only, for "*.name" triggers of response policy zones
+	regex      *regexp.Regexp
+	action     int      // action of a response policy zone rule
+	records    []dns.RR // local data of a response policy zone rule
+
+	clients    []*net.IPNet
+	notClients []*net.IPNet
+	dnstypes   []uint16
+	notTypes   []uint16
+	denyallow  []string
+}
+
+// Blocks reports whether the rule blocks, rather than allows, the names it matches
+func (r *BlockRule) Blocks() bool {
+	return !r.allow
+}
+
+// applies reports whether the modifiers of the rule accept a query
+func (r *BlockRule) applies(name string, qtype uint16, client net.IP) bool {
+	if len(r.dnstypes) > 0 && !containsType(r.dnstypes, qtype) || containsType(r.notTypes, qtype) {
+		return false
+	}
+	if len(r.clients) > 0 && (client == nil || !containsIP(r.clients, client)) {
+		return false
+	}
+	if client != nil && containsIP(r.notClients, client) {
+		return false
+	}
+	for _, domain := range r.denyallow {
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			return false
+		}
+	}
+	return r.regex == nil || r.regex.MatchString(name)
+}
+
+func containsType(types []uint16, qtype uint16) bool {
+	for _, t := range types {
+		if t == qtype {
+			return true
+		}
+	}
+	return false
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// errUnsupported is returned for lines which are valid filter rules but not
+// for DNS filtering, such as url and cosmetic rules
+var errUnsupported = errors.New("unsupported rule")
+
+var (
+	domainPattern = regexp.MustCompile(`^[a-z0-9_]([a-z0-9_.-]*[a-z0-9_])?$`)
+	globPattern   = regexp.MustCompile(`^[a-z0-9_.*-]+$`)
+	// a comment after a rule, "tracker.example.com #Tracker"
+	trailingComment = regexp.MustCompile(`\s+#.*$`)
+)
+
+// parseRule parses a line of a filter list or hosts file, comments and
+// empty lines return no rule
+func parseRule(text, source string, line int) ([]*BlockRule, error) {
+	text = trailingComment.ReplaceAllString(strings.TrimSpace(text), "")
+	if text == "" || text[0] == '!' || text[0] == '#' || text[0] == '[' {
+		return nil, nil
+	}
+	for _, marker := range []string{"##", "#@#", "#?#", "#$#", "#%#"} {
+		if strings.Contains(text, marker) {
+			return nil, errUnsupported
+		}
+	}
+
+	// hosts file line, the names are blocked alone
+	if fields := strings.Fields(text); len(fields) > 1 && net.ParseIP(fields[0]) != nil {
+		var rules []*BlockRule
+		for _, name := range fields[1:] {
+			if strings.HasPrefix(name, "#") {
+				break
+			}
+			name = normalize(name)
+			if !domainPattern.MatchString(name) {
+				return nil, errors.Errorf("invalid host name %s", name)
+			}
+			rules = append(rules, &BlockRule{Source: source, Line: line, Text: text, name: name})
+		}
+		return rules, nil
+	}
+
+	r := &BlockRule{Source: source, Line: line, Text: text}
+	pattern := text
+	if strings.HasPrefix(pattern, "@@") {
+		r.allow = true
+		pattern = pattern[2:]
+	}
+
+	// options follow the last $, except inside a regular expression
+	options := ""
+	if i := strings.LastIndexByte(pattern, '$'); i >= 0 &&
+		(!strings.HasPrefix(pattern, "/") || strings.LastIndexByte(pattern, '/') < i) {
+		pattern, options = pattern[:i], pattern[i+1:]
+	}
+	if options != "" {
+		if err := r.parseOptions(options); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid regular expression %s", pattern)
+		}
+		r.regex = re
+		return []*BlockRule{r}, nil
+	}
+
+	pattern = strings.ToLower(pattern)
+	subdomains, start, end := false, false, false
+	switch {
+	case strings.HasPrefix(pattern, "||"):
+		subdomains, pattern = true, pattern[2:]
+	case strings.HasPrefix(pattern, "|"):
+		start, pattern = true, pattern[1:]
+	}
+	if strings.HasSuffix(pattern, "^|") {
+		end, pattern = true, pattern[:len(pattern)-2]
+	} else if strings.HasSuffix(pattern, "^") || strings.HasSuffix(pattern, "|") {
+		end, pattern = true, pattern[:len(pattern)-1]
+	}
+	pattern = UnFqdn(pattern)
+
+	switch {
+	case domainPattern.MatchString(pattern):
+		if start && !end {
+			// |example.org matches any name starting with it
+			break
+		}
+		r.name, r.subdomains = pattern, !start
+		return []*BlockRule{r}, nil
+	case !globPattern.MatchString(pattern):
+		return nil, errUnsupported
+	}
+
+	expr := strings.Replace(regexp.QuoteMeta(pattern), `\*`, ".*", -1)
+	switch {
+	case subdomains:
+		expr = `(^|\.)` + expr
+	case start:
+		expr = "^" + expr
+	}
+	if end {
+		expr += "$"
+	}
+	r.regex = regexp.MustCompile(expr)
+	return []*BlockRule{r}, nil
+}
+
+// parseOptions parses the comma separated modifiers of a rule
+func (r *BlockRule) parseOptions(options string) error {
+	for _, option := range strings.Split(options, ",") {
+		key, value := option, ""
+		if i := strings.IndexByte(option, '='); i >= 0 {
+			key, value = option[:i], option[i+1:]
+		}
+
+		switch key {
+		case "important":
+			r.important = true
+		case "client":
+			for _, client := range strings.Split(value, "|") {
+				negate := strings.HasPrefix(client, "~")
+				ipnet, err := parseClient(strings.TrimPrefix(client, "~"))
+				if err != nil {
+					return err
+				}
+				if negate {
+					r.notClients = append(r.notClients, ipnet)
+				} else {
+					r.clients = append(r.clients, ipnet)
+				}
+			}
+		case "dnstype":
+			for _, name := range strings.Split(value, "|") {
+				negate := strings.HasPrefix(name, "~")
+				qtype, ok := dns.StringToType[strings.ToUpper(strings.TrimPrefix(name, "~"))]
+				if !ok {
+					return errors.Errorf("unknown dns type %s", name)
+				}
+				if negate {
+					r.notTypes = append(r.notTypes, qtype)
+				} else {
+					r.dnstypes = append(r.dnstypes, qtype)
+				}
+			}
+		case "denyallow":
+			for _, domain := range strings.Split(value, "|") {
+				r.denyallow = append(r.denyallow, normalize(domain))
+			}
+		default:
+			return errUnsupported
+		}
+	}
+	return nil
+}
+
+// parseClient parses an ip or a cidr of a $client modifier
+func parseClient(s string) (*net.IPNet, error) {
+	if _, ipnet, err := net.ParseCIDR(s); err == nil {
+		return ipnet, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, errUnsupported
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// parseFilterList adds the rules of a filter list or hosts file to cache,
+// source and category are recorded in each rule. It returns the number of
+// rules added and the number of lines skipped.
+func parseFilterList(path, source, category string, cache *BlockList) (int, int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "failed to open filter list: %s", path)
+	}
+	defer file.Close()
+
+	added, skipped := 0, 0
+	line := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line++
+		rules, err := parseRule(scanner.Text(), source, line)
+		if err != nil {
+			skipped++
+			continue
+		}
+		for _, r := range rules {
+			r.Category = category
+			cache.Add(r)
+		}
+		added += len(rules)
+	}
+	if err := scanner.Err(); err != nil {
+		return added, skipped, errors.Wrapf(err, "failed to scan filter list: %s", path)
+	}
+
+	return added, skipped, nil
+}
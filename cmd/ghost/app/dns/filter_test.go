@@ -0,0 +1,69 @@
+package dns
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseRule(t *testing.T) {
+	for text, n := range map[string]int{
+		"":                                    0,
+		"! comment":                           0,
+		"# comment":                           0,
+		"[Adblock Plus 2.0]":                  0,
+		"||example.org^":                      1,
+		"@@||example.org^$important":          1,
+		"|example.org^":                       1,
+		"example.org":                         1,
+		"0.0.0.0 a.org b.org # comment":       2,
+		"tracker.example.com #Tracker":        1,
+		"/^ad[0-9]+\\.example\\.org$/":        1,
+		"/ad$/$dnstype=A|~AAAA":               1,
+		"||ad*.example.org^$client=~10.0.0.1": 1,
+	} {
+		rules, err := parseRule(text, "test", 1)
+		if err != nil || len(rules) != n {
+			t.Errorf("%q: expected %d rules, got %d %v", text, n, len(rules), err)
+		}
+	}
+
+	for _, text := range []string{
+		"example.org##.ad",
+		"||example.org^$third-party",
+		"||example.org/ads.js",
+		"||example.org^$dnstype=BOGUS",
+		"||example.org^$client=laptop",
+		"/[/",
+	} {
+		if _, err := parseRule(text, "test", 1); err == nil {
+			t.Errorf("%q: expected an error", text)
+		}
+	}
+}
+
+func TestParseFilterList(t *testing.T) {
+	f, err := ioutil.TempFile("", "filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("! title\n||ads.example.org^\n||example.org^$third-party\n127.0.0.1 tracker.org\n")
+	f.Close()
+
+	b := NewBlockList()
+	added, skipped, err := parseFilterList(f.Name(), "list", "", b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 2 || skipped != 1 || b.Length() != 2 {
+		t.Errorf("expected 2 rules and 1 skipped, got %d and %d", added, skipped)
+	}
+
+	r := b.Lookup("www.ads.example.org", dns.TypeA, nil)
+	if r == nil || r.Source != "list" || r.Line != 2 || r.Text != "||ads.example.org^" {
+		t.Errorf("unexpected attribution %+v", r)
+	}
+}
@@ -0,0 +1,216 @@
+package dns
+
+import (
+	"bufio"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// group is a [[groups]] table of the config, a policy for some clients
+type group struct {
+	Name      string
+	Clients   []string // ips, cidrs or mac addresses
+	Blocking  *bool    // blocking is on unless set to false
+	Lists     []string // lists to block with, all lists of the config when empty
+	Blocklist []string
+	Whitelist []string
+	Upstream  string // nameserver group for names without route
+}
+
+// groupSource prefixes the source of the blocklist and whitelist entries of
+// a group, "group:kids:blocklist", which only apply to that group
+const groupSource = "group:"
+
+// clientGroup is a group compiled for matching clients and rules
+type clientGroup struct {
+	name     string
+	nets     []*net.IPNet
+	macs     []string
+	blocking bool
+	upstream string
+	// exclude holds the lists the group doesn't use, among all lists of the
+	// config and of the groups
+	exclude map[string]bool
+}
+
+// parseGroups compiles the groups of c, the last one is the default group of
+// the clients matching no other, which uses the lists of the config alone
+func parseGroups(c *config) ([]*clientGroup, error) {
+	global := make(map[string]bool)
+	for _, uri := range configURIs(c) {
+		global[uri] = true
+	}
+	// lists named by groups alone are not used by others, while the rules of
+	// category lists are tagged and used by schedules
+	groupOnly := make(map[string]bool)
+	for _, uri := range listURIs(c) {
+		if !global[uri] && categoryOf(c, uri) == "" {
+			groupOnly[uri] = true
+		}
+	}
+
+	var groups []*clientGroup
+	names := make(map[string]bool)
+	for _, gr := range c.Groups {
+		if gr.Name == "" || strings.Contains(gr.Name, ":") {
+			return nil, errors.Errorf("invalid group name %q", gr.Name)
+		}
+		if names[gr.Name] {
+			return nil, errors.Errorf("duplicate group %s", gr.Name)
+		}
+		names[gr.Name] = true
+
+		g := &clientGroup{name: gr.Name, blocking: gr.Blocking == nil || *gr.Blocking, upstream: gr.Upstream}
+		if len(gr.Clients) == 0 {
+			return nil, errors.Errorf("no clients in group %s", gr.Name)
+		}
+		for _, client := range gr.Clients {
+			if mac, err := net.ParseMAC(client); err == nil {
+				g.macs = append(g.macs, mac.String())
+				continue
+			}
+			ipnet, err := parseClient(client)
+			if err != nil {
+				return nil, errors.Errorf("invalid client %s in group %s", client, gr.Name)
+			}
+			g.nets = append(g.nets, ipnet)
+		}
+
+		g.exclude = groupOnly
+		if len(gr.Lists) > 0 {
+			lists := make(map[string]bool)
+			for _, uri := range gr.Lists {
+				lists[uri] = true
+			}
+			g.exclude = make(map[string]bool)
+			for _, uri := range listURIs(c) {
+				if !lists[uri] && categoryOf(c, uri) == "" {
+					g.exclude[uri] = true
+				}
+			}
+		}
+		groups = append(groups, g)
+	}
+
+	return append(groups, &clientGroup{blocking: true, exclude: groupOnly}), nil
+}
+
+// match reports whether client is a member of the group
+func (g *clientGroup) match(client net.IP) bool {
+	if client == nil {
+		return false
+	}
+	if containsIP(g.nets, client) {
+		return true
+	}
+	if len(g.macs) == 0 {
+		return false
+	}
+	mac := gARP.MAC(client)
+	for _, m := range g.macs {
+		if m == mac {
+			return true
+		}
+	}
+	return false
+}
+
+// Name returns the name of the group, which is empty for the default group
+func (g *clientGroup) Name() string {
+	if g == nil {
+		return ""
+	}
+	return g.name
+}
+
+// blocks reports whether queries of the group are checked against the blocklist
+func (g *clientGroup) blocks() bool {
+	return g == nil || g.blocking
+}
+
+// uses reports whether rules from source apply to the group, a nil group
+// uses the rules of all lists
+func (g *clientGroup) uses(source string) bool {
+	if strings.HasPrefix(source, groupSource) {
+		return g != nil && g.name != "" && strings.HasPrefix(source, groupSource+g.name+":")
+	}
+	return g == nil || !g.exclude[source]
+}
+
+// groupOf returns the group of client, the first one it is a member of, or
+// the default group
+func (c *config) groupOf(client net.IP) *clientGroup {
+	for _, g := range c.groups {
+		if g.name == "" || g.match(client) {
+			return g
+		}
+	}
+	return nil
+}
+
+// arpTable maps ipv4 addresses of the local network to mac addresses, from
+// the ARP table of the kernel, which is read again after maxAge
+type arpTable struct {
+	mu     sync.Mutex
+	path   string
+	maxAge time.Duration
+	read   time.Time
+	macs   map[string]string
+}
+
+var gARP = &arpTable{path: "/proc/net/arp", maxAge: 10 * time.Second}
+
+// MAC returns the mac address of ip, or "" if it is unknown
+func (t *arpTable) MAC(ip net.IP) string {
+	if ip.To4() == nil {
+		return ""
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if time.Since(t.read) > t.maxAge {
+		macs, err := readARP(t.path)
+		if err != nil {
+			log.Printf("failed to read ARP table: %s\n", err)
+		}
+		t.macs, t.read = macs, time.Now()
+	}
+	return t.macs[ip.To4().String()]
+}
+
+// readARP reads the complete entries of an ARP table in the format of
+// /proc/net/arp
+//
+//	IP address       HW type     Flags       HW address            Mask     Device
+//	192.168.1.10     0x1         0x2         aa:bb:cc:dd:ee:ff     *        eth0
+func readARP(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	macs := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// the header and incomplete entries, which have flags 0x0
+		if len(fields) < 4 || fields[2] == "0x0" {
+			continue
+		}
+		ip, mac := net.ParseIP(fields[0]), fields[3]
+		hw, err := net.ParseMAC(mac)
+		if ip == nil || err != nil {
+			continue
+		}
+		macs[ip.To4().String()] = hw.String()
+	}
+	return macs, scanner.Err()
+}
@@ -0,0 +1,156 @@
+package dns
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/miekg/dns"
+)
+
+const testGroups = `
+easylists = ["https://example.org/easylist.txt"]
+sources = ["https://example.org/hosts"]
+
+[upstreams]
+family = ["185.228.168.168:53"]
+
+[[groups]]
+name = "kids"
+clients = ["192.168.1.32/28", "aa:bb:cc:dd:ee:ff"]
+lists = ["https://example.org/hosts", "https://example.org/adult.txt"]
+blocklist = ["youtube.com"]
+whitelist = ["ads.example.com"]
+upstream = "family"
+
+[[groups]]
+name = "servers"
+clients = ["10.0.0.0/24"]
+blocking = false
+`
+
+func TestParseGroups(t *testing.T) {
+	var c config
+	if _, err := toml.Decode(testGroups, &c); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateConfig(&c); err != nil {
+		t.Fatal(err)
+	}
+	groups, err := parseGroups(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.groups = groups
+
+	kids, servers, other := c.groupOf(net.ParseIP("192.168.1.33")), c.groupOf(net.ParseIP("10.0.0.1")),
+		c.groupOf(net.ParseIP("192.168.1.1"))
+	if kids.Name() != "kids" || servers.Name() != "servers" || other.Name() != "" {
+		t.Fatalf("unexpected groups %s, %s and %q", kids.Name(), servers.Name(), other.Name())
+	}
+	if !kids.blocks() || servers.blocks() || !other.blocks() {
+		t.Error("blocking should only be off for servers")
+	}
+	if kids.upstream != "family" || other.upstream != "" {
+		t.Error("kids should resolve on family alone")
+	}
+
+	cases := []struct {
+		group  *clientGroup
+		source string
+		uses   bool
+	}{
+		{kids, "https://example.org/hosts", true},
+		{kids, "https://example.org/adult.txt", true},
+		{kids, "https://example.org/easylist.txt", false},
+		{kids, "group:kids:blocklist", true},
+		{kids, "blocklist", true},
+		{servers, "https://example.org/easylist.txt", true},
+		{servers, "https://example.org/adult.txt", false},
+		{servers, "group:kids:blocklist", false},
+		{other, "https://example.org/adult.txt", false},
+		{other, "group:kids:whitelist", false},
+		{other, "whitelist", true},
+		{nil, "https://example.org/adult.txt", true},
+		{nil, "group:kids:blocklist", false},
+	}
+	for _, tc := range cases {
+		if uses := tc.group.uses(tc.source); uses != tc.uses {
+			t.Errorf("group %q uses %s: expected %v, got %v", tc.group.Name(), tc.source, tc.uses, uses)
+		}
+	}
+
+	invalid := []group{
+		{Name: "", Clients: []string{"10.0.0.1"}},
+		{Name: "nobody"},
+		{Name: "bad", Clients: []string{"not-a-client"}},
+	}
+	for _, g := range invalid {
+		c.Groups = []group{g}
+		if err := validateConfig(&c); err == nil {
+			t.Errorf("invalid group %+v was accepted", g)
+		}
+	}
+	c.Groups = []group{{Name: "kids", Clients: []string{"10.0.0.1"}, Upstream: "unknown"}}
+	if err := validateConfig(&c); err == nil {
+		t.Error("group with unknown upstream was accepted")
+	}
+}
+
+func TestGroupLookup(t *testing.T) {
+	kids := &clientGroup{name: "kids", blocking: true, exclude: map[string]bool{"easylist": true}}
+	def := &clientGroup{blocking: true, exclude: map[string]bool{"adult": true}}
+
+	b := NewBlockList()
+	b.AddRule("||ads.example.com^", "easylist", 1)
+	b.AddRule("||porn.example.com^", "adult", 1)
+	b.AddRule("||youtube.com^", "group:kids:blocklist", 1)
+	b.AddRule("@@||example.com^", "group:kids:whitelist", 1)
+
+	cases := []struct {
+		name    string
+		group   *clientGroup
+		blocked bool
+	}{
+		{"ads.example.com", def, true},
+		{"ads.example.com", kids, false},
+		{"porn.example.com", def, false},
+		{"porn.example.com", kids, true},
+		{"www.youtube.com", kids, true},
+		{"www.youtube.com", def, false},
+	}
+	for _, c := range cases {
+		r := b.lookup(c.name, dns.TypeA, nil, c.group, nil)
+		if blocked := r != nil && r.Blocks(); blocked != c.blocked {
+			t.Errorf("%s for group %q: expected blocked %v, got %+v", c.name, c.group.Name(), c.blocked, r)
+		}
+	}
+}
+
+func TestReadARP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "arp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "arp")
+	table := `IP address       HW type     Flags       HW address            Mask     Device
+192.168.1.10     0x1         0x2         AA:BB:CC:DD:EE:FF     *        eth0
+192.168.1.11     0x1         0x0         00:00:00:00:00:00     *        eth0
+`
+	if err := ioutil.WriteFile(path, []byte(table), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	arp := &arpTable{path: path}
+	if mac := arp.MAC(net.ParseIP("192.168.1.10")); mac != "aa:bb:cc:dd:ee:ff" {
+		t.Errorf("unexpected mac %q", mac)
+	}
+	if mac := arp.MAC(net.ParseIP("192.168.1.11")); mac != "" {
+		t.Errorf("incomplete entry should be skipped, got %q", mac)
+	}
+}
@@ -1,8 +1,12 @@
 package dns
 
 import (
+	"context"
 	"log"
 	"net"
+	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/miekg/dns"
@@ -29,10 +33,13 @@ func (q *Question) String() string {
 
 // QuestionCacheEntry represents a full query from a client with metadata
 type QuestionCacheEntry struct {
-	Date    int64    `json:"date"`
-	Remote  string   `json:"client"`
-	Blocked bool     `json:"blocked"`
-	Query   Question `json:"query"`
+	Date    int64      `json:"date"`
+	Remote  string     `json:"client"`
+	Blocked bool       `json:"blocked"`
+	Reason  string     `json:"reason,omitempty"` // "name" or "cname" for blocked queries
+	Rule    *BlockRule `json:"rule,omitempty"`   // rule which blocked the query
+	Group   string     `json:"group,omitempty"`  // client group the query was resolved under
+	Query   Question   `json:"query"`
 }
 
 // DNSHandler type
@@ -40,28 +47,59 @@ type DNSHandler struct {
 	resolver *Resolver
 	cache    Cache // cache success
 	negCache Cache // cache failure
+	flight   flightGroup
+	quit     chan struct{}
+	inflight sync.WaitGroup
+	// inflightMu orders adding to inflight from zero before waiting on it
+	inflightMu sync.Mutex
 }
 
 // NewHandler returns a new DNSHandler
 func NewHandler() *DNSHandler {
-	resolver := &Resolver{}
-
-	cache := &MemoryCache{
-		Backend:  make(map[string]Mesg, gConfig.Maxcount),
-		Expire:   gConfig.Expire.Duration,
-		Maxcount: gConfig.Maxcount,
+	resolver := NewResolver()
+
+	memCache := &MemoryCache{
+		Backend:  make(map[string]Mesg, getConfig().Maxcount),
+		Expire:   getConfig().Expire.Duration,
+		MinTTL:   getConfig().MinTTL.Duration,
+		MaxTTL:   getConfig().MaxTTL.Duration,
+		Maxcount: getConfig().Maxcount,
+
+		StaleWindow:    getConfig().StaleWindow.Duration,
+		PrefetchWindow: getConfig().PrefetchWindow.Duration,
+		PrefetchHits:   getConfig().PrefetchHits,
 	}
+	// negative answers live for their SOA TTL, failures without answer for FailureTTL
 	negCache := &MemoryCache{
 		Backend:  make(map[string]Mesg),
-		Expire:   gConfig.Expire.Duration / 2,
-		Maxcount: gConfig.Maxcount,
+		Expire:   getConfig().FailureTTL.Duration,
+		MaxTTL:   getConfig().MaxTTL.Duration,
+		Maxcount: getConfig().Maxcount,
 	}
 
-	return &DNSHandler{resolver, cache, negCache}
+	var cache Cache = memCache
+	if getConfig().CacheType == "file" {
+		fileCache := &FileCache{memCache, filepath.Join(getConfig().DataDir, getConfig().CacheFile)}
+		if err := fileCache.Load(); err != nil {
+			log.Printf("failed to load cache: %s\n", err)
+		}
+		cache = fileCache
+	}
+
+	quit := make(chan struct{})
+	go memCache.Janitor(getConfig().JanitorInterval.Duration, quit)
+	go negCache.Janitor(getConfig().JanitorInterval.Duration, quit)
+	go resolver.Probe(getConfig().ProbeInterval.Duration, quit)
+
+	return &DNSHandler{
+		resolver: resolver,
+		cache:    cache,
+		negCache: negCache,
+		quit:     quit,
+	}
 }
 
 func (h *DNSHandler) do(Net string, w dns.ResponseWriter, req *dns.Msg) {
-	defer w.Close()
 	q := req.Question[0]
 	Q := Question{
 		UnFqdn(q.Name),
@@ -71,91 +109,94 @@ func (h *DNSHandler) do(Net string, w dns.ResponseWriter, req *dns.Msg) {
 	}
 
 	var remote net.IP
-	if Net == "tcp" {
-		remote = w.RemoteAddr().(*net.TCPAddr).IP
-	} else {
-		remote = w.RemoteAddr().(*net.UDPAddr).IP
+	switch addr := w.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		remote = addr.IP
+	case *net.UDPAddr:
+		remote = addr.IP
 	}
+	group := getConfig().groupOf(remote)
+	// categories of schedules in effect for the group, evaluated on every query
+	active := getConfig().activeCategories(group, time.Now())
 	log.Printf("%s lookup %s\n", remote, Q)
 
-	// Only lookup cache when qclass == 'IN', qtype == 'A'|'AAAA'
-	// tcp and udp use same cache key
+	// only plain tcp clients are answered from tcp lookups, others can take
+	// large answers, which are retried over tcp when truncated
+	upNet := "udp"
+	if Net == "tcp" {
+		upNet = "tcp"
+	}
+
+	// the blocklist is checked before the cache, as rules may depend on the client
+	qrule := h.blockRule(q, remote, group, active)
+	if qrule != nil && qrule.Blocks() {
+		h.block(upNet, w, req, Q, remote, group, qrule, "name")
+		return
+	}
+	// the answers of an allowed name are not checked, its exception wins
+	// over rules for the names it points to
+	cnameRule := func(m *dns.Msg) *BlockRule {
+		if qrule != nil {
+			return nil
+		}
+		return h.cnameRule(m, q.Qtype, remote, group, active)
+	}
+
+	// tcp and udp use same cache key, which is made of the full question, and
+	// the group for groups resolving on their own upstream
 	key := Q.String()
-	IPQuery := h.isIPQuery(q)
-	if IPQuery != notIPQuery {
-		mesg, blocked, err := h.cache.Get(key)
-		if err != nil {
-			if _, _, err = h.negCache.Get(key); err != nil {
+	if group != nil && group.upstream != "" {
+		key += " @" + group.name
+	}
+	if h.isCacheable(q) {
+		mesg, _, err := h.cache.Get(key)
+		_, stale := err.(KeyStale)
+		if err != nil && !stale {
+			if mesg, _, err = h.negCache.Get(key); err != nil {
 				log.Printf("%s didn't hit cache\n", Q)
+			} else if mesg == nil {
+				log.Printf("%s hit failure cache\n", Q)
+				dns.HandleFailed(w, req)
+				return
 			} else {
 				log.Printf("%s hit negative cache\n", Q)
-				dns.HandleFailed(w, req)
+				mesg.Id = req.Id
+				h.WriteReplyMsg(w, mesg)
 				return
 			}
 		} else if checkFakeIP(mesg) {
 			log.Printf("remove fakeip for %s from cache\n", Q)
 			h.cache.Remove(key)
 		} else {
-			if blocked {
-				log.Printf("%s hit blocked cache\n", Q)
+			if stale {
+				log.Printf("%s hit stale cache\n", Q)
 			} else {
 				log.Printf("%s hit cache\n", Q)
 			}
 
-			// we need this copy against concurrent modification of Id
-			msg := *mesg
-			msg.Id = req.Id
-			h.WriteReplyMsg(w, &msg)
-			return
-		}
-
-		if gBlockCache.Exists(Q.Qname) {
-			log.Printf("%s found in blocklist\n", Q.Qname)
-
-			m := new(dns.Msg)
-			m.SetReply(req)
-			switch IPQuery {
-			case _IP4Query:
-				rrHeader := dns.RR_Header{
-					Name:   q.Name,
-					Rrtype: dns.TypeA,
-					Class:  dns.ClassINET,
-					Ttl:    gConfig.TTL,
-				}
-				a := &dns.A{Hdr: rrHeader, A: net.ParseIP(gConfig.Nullroute)}
-				m.Answer = append(m.Answer, a)
-			case _IP6Query:
-				rrHeader := dns.RR_Header{
-					Name:   q.Name,
-					Rrtype: dns.TypeAAAA,
-					Class:  dns.ClassINET,
-					Ttl:    gConfig.TTL,
-				}
-				a := &dns.AAAA{Hdr: rrHeader, AAAA: net.ParseIP(gConfig.Nullroutev6)}
-				m.Answer = append(m.Answer, a)
+			if h.cache.Refresh(key) {
+				go h.refresh(upNet, req.Copy(), key, group)
 			}
-			h.WriteReplyMsg(w, m)
 
-			// cache the block
-			err := h.cache.Set(key, m, true)
-			if err != nil {
-				log.Printf("failed to set %s block cache: %s\n", Q, err)
+			if rule := cnameRule(mesg); rule != nil {
+				h.block(upNet, w, req, Q, remote, group, rule, "cname")
+				return
 			}
 
-			// log query
-			NewEntry := QuestionCacheEntry{Date: time.Now().Unix(), Remote: remote.String(), Query: Q, Blocked: true}
-			gQuestionCache.Add(NewEntry)
-
+			// cache returns a private copy, so Id can be modified safely
+			mesg.Id = req.Id
+			h.WriteReplyMsg(w, mesg)
 			return
 		}
 	}
 
-	// log query
-	NewEntry := QuestionCacheEntry{Date: time.Now().Unix(), Remote: remote.String(), Query: Q, Blocked: false}
-	go gQuestionCache.Add(NewEntry)
-
-	mesg, err := h.resolver.Lookup(Net, req)
+	mesg, err := h.lookup(upNet, req, key, group)
 	if err != nil {
+		// log query
+		NewEntry := QuestionCacheEntry{Date: time.Now().Unix(), Remote: remote.String(), Query: Q, Blocked: false,
+			Group: group.Name()}
+		go gQuestionCache.Add(NewEntry)
+
 		dns.HandleFailed(w, req)
 
 		// cache the failure, too!
@@ -164,39 +205,322 @@ func (h *DNSHandler) do(Net string, w dns.ResponseWriter, req *dns.Msg) {
 		}
 		return
 	}
-	if mesg.Truncated && Net == "udp" {
-		mesg, err = h.resolver.Lookup("tcp", req)
+
+	// the answer is cached as is, a cname block is checked again on each hit
+	if rule := cnameRule(mesg); rule != nil {
+		h.block(upNet, w, req, Q, remote, group, rule, "cname")
+	} else {
+		// log query
+		NewEntry := QuestionCacheEntry{Date: time.Now().Unix(), Remote: remote.String(), Query: Q, Blocked: false,
+			Group: group.Name()}
+		go gQuestionCache.Add(NewEntry)
+
+		h.WriteReplyMsg(w, mesg)
+	}
+
+	if !h.isCacheable(q) {
+		return
+	}
+	if cacheableMsg(mesg) {
+		err = h.cache.Set(key, mesg, false)
+		if err != nil {
+			log.Printf("failed to set %s cache: %s\n", Q, err)
+		}
+		log.Printf("insert %s into cache\n", Q)
+	} else if negativeMsg(mesg) {
+		err = h.negCache.Set(key, mesg, false)
 		if err != nil {
-			log.Printf("failed to resolve backup tcp query %s: %s\n", Q, err)
-			dns.HandleFailed(w, req)
+			log.Printf("failed to set %s negative cache: %s\n", Q, err)
+		}
+		log.Printf("insert %s into negative cache\n", Q)
+	}
+}
 
-			// cache the failure, too!
-			if err = h.negCache.Set(key, nil, false); err != nil {
-				log.Printf("failed to set %s negative cache: %s\n", Q, err)
+// blockRule returns the rule deciding q from client of group, with the
+// categories in active, which is an exception for an allowed name, or nil if
+// no rule matches
+func (h *DNSHandler) blockRule(q dns.Question, client net.IP, group *clientGroup, active map[string]bool) *BlockRule {
+	if q.Qclass != dns.ClassINET || !group.blocks() {
+		return nil
+	}
+	return gBlockCache.lookup(q.Name, q.Qtype, client, group, active)
+}
+
+// cnameRule returns the rule blocking a name in the answer section of m,
+// which are the CNAME targets and owners of the records other than the
+// question, so that trackers cloaked behind a CNAME of a first party name are
+// blocked too. It returns nil if no name is blocked.
+func (h *DNSHandler) cnameRule(m *dns.Msg, qtype uint16, client net.IP, group *clientGroup,
+	active map[string]bool) *BlockRule {
+	if m == nil || len(m.Question) == 0 || m.Question[0].Qclass != dns.ClassINET || !group.blocks() {
+		return nil
+	}
+
+	qname := strings.ToLower(m.Question[0].Name)
+	for _, rr := range m.Answer {
+		names := []string{rr.Header().Name}
+		if cname, ok := rr.(*dns.CNAME); ok {
+			names = append(names, cname.Target)
+		}
+		for _, name := range names {
+			if strings.ToLower(name) == qname {
+				continue
+			}
+			if rule := gBlockCache.lookup(name, qtype, client, group, active); rule != nil && rule.Blocks() {
+				return rule
 			}
-			return
 		}
 	}
+	return nil
+}
 
-	h.WriteReplyMsg(w, mesg)
+// block answers a blocked query and logs it with the reason, which is
+// "name" when the question is blocked and "cname" when a name in the answer is
+func (h *DNSHandler) block(Net string, w dns.ResponseWriter, req *dns.Msg, Q Question, remote net.IP,
+	group *clientGroup, rule *BlockRule, reason string) {
+	log.Printf("%s blocked by %s:%d %s (%s)\n", Q.Qname, rule.Source, rule.Line, rule.Text, reason)
+	if m := h.blockMsg(req, rule); m != nil {
+		if rule.action == rpzLocal {
+			h.chase(Net, m, group)
+		}
+		h.WriteReplyMsg(w, m)
+	}
 
-	if IPQuery != notIPQuery && len(mesg.Answer) > 0 {
-		err = h.cache.Set(key, mesg, false)
+	// log query
+	NewEntry := QuestionCacheEntry{Date: time.Now().Unix(), Remote: remote.String(), Query: Q,
+		Blocked: true, Reason: reason, Rule: rule, Group: group.Name()}
+	gQuestionCache.Add(NewEntry)
+}
+
+// chase resolves the target of a CNAME answered from local data upstream,
+// for a client of group, and appends its records to m
+func (h *DNSHandler) chase(Net string, m *dns.Msg, group *clientGroup) {
+	q := m.Question[0]
+	if len(m.Answer) != 1 || q.Qtype == dns.TypeCNAME {
+		return
+	}
+	cname, ok := m.Answer[0].(*dns.CNAME)
+	if !ok {
+		return
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion(cname.Target, q.Qtype)
+	res, err := h.resolve(Net, req, group)
+	if err != nil {
+		log.Printf("failed to resolve %s for local data of %s: %s\n", cname.Target, q.Name, err)
+		return
+	}
+	m.Answer = append(m.Answer, res.Answer...)
+}
+
+// blockMsg returns the answer to a blocked query, which is the action of a
+// response policy zone rule or else the configured block mode, or nil for no
+// answer at all. Negative answers carry a SOA with the block TTL for clients
+// to cache them.
+func (h *DNSHandler) blockMsg(req *dns.Msg, rule *BlockRule) *dns.Msg {
+	mode := getConfig().BlockMode
+	switch rule.action {
+	case rpzNXDOMAIN:
+		mode = "nxdomain"
+	case rpzNODATA:
+		mode = "nodata"
+	case rpzDrop:
+		return nil
+	case rpzLocal:
+		if m := h.localMsg(req, rule); len(m.Answer) > 0 {
+			return m
+		}
+		mode = "nodata"
+	}
+
+	q := req.Question[0]
+	ttl := getConfig().TTL
+	m := new(dns.Msg)
+	m.SetReply(req)
+
+	var ip net.IP
+	switch mode {
+	case "nxdomain":
+		m.Rcode = dns.RcodeNameError
+	case "refused":
+		m.Rcode = dns.RcodeRefused
+		return m
+	case "null":
+		switch h.isIPQuery(q) {
+		case _IP4Query:
+			ip = net.IPv4zero
+		case _IP6Query:
+			ip = net.IPv6zero
+		}
+	case "nodata":
+	default:
+		switch h.isIPQuery(q) {
+		case _IP4Query:
+			ip = net.ParseIP(getConfig().Nullroute)
+		case _IP6Query:
+			ip = net.ParseIP(getConfig().Nullroutev6)
+		}
+	}
+
+	rrHeader := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: ttl}
+	switch {
+	case ip != nil && q.Qtype == dns.TypeA:
+		m.Answer = append(m.Answer, &dns.A{Hdr: rrHeader, A: ip})
+	case ip != nil && q.Qtype == dns.TypeAAAA:
+		m.Answer = append(m.Answer, &dns.AAAA{Hdr: rrHeader, AAAA: ip})
+	default:
+		rrHeader.Rrtype = dns.TypeSOA
+		m.Ns = append(m.Ns, &dns.SOA{
+			Hdr:     rrHeader,
+			Ns:      "fake-for-negative-caching.ghost.",
+			Mbox:    "hostmaster.ghost.",
+			Serial:  1,
+			Refresh: 1800,
+			Retry:   900,
+			Expire:  604800,
+			Minttl:  ttl,
+		})
+	}
+	return m
+}
+
+// localMsg answers req from the local data of a response policy zone rule,
+// the records of the question type, or a CNAME, are answered for the question name
+func (h *DNSHandler) localMsg(req *dns.Msg, rule *BlockRule) *dns.Msg {
+	q := req.Question[0]
+	m := new(dns.Msg)
+	m.SetReply(req)
+	for _, rr := range rule.records {
+		rrtype := rr.Header().Rrtype
+		if rrtype != q.Qtype && rrtype != dns.TypeCNAME {
+			continue
+		}
+		rr = dns.Copy(rr)
+		rr.Header().Name = q.Name
+		m.Answer = append(m.Answer, rr)
+	}
+	return m
+}
+
+// Flush writes the cache to disk when it is persistent
+func (h *DNSHandler) Flush() error {
+	if c, ok := h.cache.(PersistentCache); ok {
+		return c.Save()
+	}
+	return nil
+}
+
+// lookup resolves req upstream for a client of group, concurrent lookups of
+// the same key share one upstream resolution but every caller gets a reply
+// with its own Id
+func (h *DNSHandler) lookup(Net string, req *dns.Msg, key string, group *clientGroup) (*dns.Msg, error) {
+	mesg, shared, err := h.flight.Do(key, func() (*dns.Msg, error) {
+		return h.resolve(Net, req, group)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if shared {
+		mesg = mesg.Copy()
+		mesg.Id = req.Id
+	}
+	return mesg, nil
+}
+
+// resolve resolves req upstream, on the upstream of group if it has one,
+// retrying over tcp when a udp answer is truncated
+func (h *DNSHandler) resolve(Net string, req *dns.Msg, group *clientGroup) (*dns.Msg, error) {
+	var upstream string
+	if group != nil {
+		upstream = group.upstream
+	}
+	mesg, err := h.resolver.Lookup(Net, req, upstream)
+	if err != nil {
+		return nil, err
+	}
+	if mesg.Truncated && Net == "udp" {
+		mesg, err = h.resolver.Lookup("tcp", req, upstream)
 		if err != nil {
-			log.Printf("failed to set %s cache: %s\n", Q, err)
+			log.Printf("failed to resolve backup tcp query %s: %s\n",
+				UnFqdn(req.Question[0].Name), err)
+			return nil, err
 		}
-		log.Printf("insert %s into cache\n", Q)
 	}
+	return mesg, nil
+}
+
+// refresh resolves a cached question of a client of group again in background
+func (h *DNSHandler) refresh(Net string, req *dns.Msg, key string, group *clientGroup) {
+	mesg, err := h.lookup(Net, req, key, group)
+	if err != nil {
+		log.Printf("failed to refresh %s: %s\n", key, err)
+		return
+	}
+	if !cacheableMsg(mesg) || checkFakeIP(mesg) {
+		return
+	}
+
+	if err = h.cache.Set(key, mesg, false); err != nil {
+		log.Printf("failed to set %s cache: %s\n", key, err)
+		return
+	}
+	log.Printf("refresh %s in cache\n", key)
 }
 
-// DoTCP begins a tcp query
+// DoTCP answers a tcp query, in the goroutine of its connection, which reads
+// the next query of the connection once the answer is written
 func (h *DNSHandler) DoTCP(w dns.ResponseWriter, req *dns.Msg) {
-	go h.do("tcp", w, req)
+	h.begin()
+	h.track("tcp", w, req)
+}
+
+// DoTLS answers a DNS over TLS query, like DoTCP
+func (h *DNSHandler) DoTLS(w dns.ResponseWriter, req *dns.Msg) {
+	h.begin()
+	h.track("tcp-tls", w, req)
 }
 
 // DoUDP begins a udp query
 func (h *DNSHandler) DoUDP(w dns.ResponseWriter, req *dns.Msg) {
-	go h.do("udp", w, req)
+	h.begin()
+	go h.track("udp", w, req)
+}
+
+// begin counts a query in inflight
+func (h *DNSHandler) begin() {
+	h.inflightMu.Lock()
+	h.inflight.Add(1)
+	h.inflightMu.Unlock()
+}
+
+// track runs a query counted in inflight
+func (h *DNSHandler) track(Net string, w dns.ResponseWriter, req *dns.Msg) {
+	defer h.inflight.Done()
+	h.do(Net, w, req)
+}
+
+// Wait waits for in-flight queries to finish, or ctx to be done
+func (h *DNSHandler) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		h.inflightMu.Lock()
+		h.inflightMu.Unlock()
+		h.inflight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops background jobs of the handler
+func (h *DNSHandler) Close() {
+	close(h.quit)
 }
 
 func (h *DNSHandler) WriteReplyMsg(w dns.ResponseWriter, message *dns.Msg) {
@@ -227,6 +551,17 @@ func (h *DNSHandler) isIPQuery(q dns.Question) int {
 	}
 }
 
+// isCacheable reports whether answers to the question can be cached,
+// zone transfers and meta queries are always passed upstream
+func (h *DNSHandler) isCacheable(q dns.Question) bool {
+	switch q.Qtype {
+	case dns.TypeAXFR, dns.TypeIXFR, dns.TypeANY, dns.TypeMAILA, dns.TypeMAILB:
+		return false
+	default:
+		return true
+	}
+}
+
 // UnFqdn function
 func UnFqdn(s string) string {
 	if dns.IsFqdn(s) {
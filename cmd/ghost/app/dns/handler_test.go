@@ -0,0 +1,126 @@
+package dns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestBlockMsg(t *testing.T) {
+	defer setConfig(getConfig())
+
+	h := &DNSHandler{}
+	for _, c := range []struct {
+		mode   string
+		qtype  uint16
+		rcode  int
+		answer string
+	}{
+		{"ip", dns.TypeA, dns.RcodeSuccess, "10.0.0.1"},
+		{"ip", dns.TypeAAAA, dns.RcodeSuccess, ""},
+		{"ip", dns.TypeMX, dns.RcodeSuccess, ""},
+		{"null", dns.TypeA, dns.RcodeSuccess, "0.0.0.0"},
+		{"null", dns.TypeAAAA, dns.RcodeSuccess, "::"},
+		{"null", dns.TypeTXT, dns.RcodeSuccess, ""},
+		{"nxdomain", dns.TypeA, dns.RcodeNameError, ""},
+		{"nxdomain", dns.TypeSRV, dns.RcodeNameError, ""},
+		{"refused", dns.TypeA, dns.RcodeRefused, ""},
+		{"nodata", dns.TypeA, dns.RcodeSuccess, ""},
+	} {
+		setConfig(&config{BlockMode: c.mode, Nullroute: "10.0.0.1", TTL: 10})
+
+		req := new(dns.Msg)
+		req.SetQuestion("ads.example.com.", c.qtype)
+		m := h.blockMsg(req, &BlockRule{})
+		if m.Rcode != c.rcode {
+			t.Errorf("%s %s: expected rcode %s, got %s", c.mode, dns.TypeToString[c.qtype],
+				dns.RcodeToString[c.rcode], dns.RcodeToString[m.Rcode])
+		}
+
+		switch {
+		case c.answer != "":
+			if len(m.Answer) != 1 || m.Answer[0].Header().Ttl != 10 {
+				t.Errorf("%s %s: expected an answer with TTL 10, got %v", c.mode, dns.TypeToString[c.qtype], m.Answer)
+				continue
+			}
+			var ip string
+			switch rr := m.Answer[0].(type) {
+			case *dns.A:
+				ip = rr.A.String()
+			case *dns.AAAA:
+				ip = rr.AAAA.String()
+			}
+			if ip != c.answer {
+				t.Errorf("%s %s: expected %s, got %s", c.mode, dns.TypeToString[c.qtype], c.answer, ip)
+			}
+		case c.mode == "refused":
+			if len(m.Answer) != 0 || len(m.Ns) != 0 {
+				t.Errorf("refused: unexpected records %v %v", m.Answer, m.Ns)
+			}
+		default:
+			// negative answers are cacheable by their SOA
+			if len(m.Answer) != 0 || soaRecord(m) == nil || soaRecord(m).Minttl != 10 {
+				t.Errorf("%s %s: expected a negative answer with SOA, got %v", c.mode, dns.TypeToString[c.qtype], m)
+			}
+		}
+	}
+}
+
+func TestCnameRule(t *testing.T) {
+	saved := NewBlockList()
+	saved.Replace(gBlockCache)
+	defer gBlockCache.Replace(saved)
+	gBlockCache.Replace(newTestBlockList(t, "||eulerian.net^", "||tracker.com^$client=10.0.0.1"))
+
+	h := &DNSHandler{}
+	m := new(dns.Msg)
+	m.SetQuestion("metrics.shop.com.", dns.TypeA)
+	cname, _ := dns.NewRR("metrics.shop.com. 300 IN CNAME shop.eulerian.net.")
+	a, _ := dns.NewRR("shop.eulerian.net. 300 IN A 192.0.2.1")
+	m.Answer = []dns.RR{cname, a}
+
+	if rule := h.cnameRule(m, dns.TypeA, nil, nil, nil); rule == nil || rule.Line != 1 {
+		t.Errorf("cloaked tracker was not blocked: %+v", rule)
+	}
+
+	m.Answer = []dns.RR{a}
+	if rule := h.cnameRule(m, dns.TypeA, nil, nil, nil); rule == nil {
+		t.Error("owner names in the answer should be checked too")
+	}
+
+	cname, _ = dns.NewRR("metrics.shop.com. 300 IN CNAME x.tracker.com.")
+	m.Answer = []dns.RR{cname}
+	if rule := h.cnameRule(m, dns.TypeA, nil, nil, nil); rule != nil {
+		t.Errorf("rule for another client should not apply: %+v", rule)
+	}
+	if rule := h.cnameRule(m, dns.TypeA, net.ParseIP("10.0.0.1"), nil, nil); rule == nil {
+		t.Error("rule for the client should apply")
+	}
+
+	// the question itself is checked before the lookup, not here
+	gBlockCache.AddRule("||shop.com^", "test", 3)
+	a, _ = dns.NewRR("metrics.shop.com. 300 IN A 192.0.2.1")
+	m.Answer = []dns.RR{a}
+	if rule := h.cnameRule(m, dns.TypeA, nil, nil, nil); rule != nil {
+		t.Errorf("question name should be skipped: %+v", rule)
+	}
+
+	// an exception for the question wins over rules for the names it points to
+	gBlockCache.AddRule("@@||mp.weixin.qq.com^", "test", 4)
+	h = &DNSHandler{cache: &MemoryCache{Backend: make(map[string]Mesg)}}
+	cname, _ = dns.NewRR("mp.weixin.qq.com. 300 IN CNAME shop.eulerian.net.")
+	a, _ = dns.NewRR("shop.eulerian.net. 300 IN A 192.0.2.1")
+	m = new(dns.Msg)
+	m.SetQuestion("mp.weixin.qq.com.", dns.TypeA)
+	m.Answer = []dns.RR{cname, a}
+	h.cache.Set("mp.weixin.qq.com IN A", m, false)
+
+	req := new(dns.Msg)
+	req.SetQuestion("mp.weixin.qq.com.", dns.TypeA)
+	w := &dohWriter{remote: &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}}
+	h.do("udp", w, req)
+	if w.msg == nil || len(w.msg.Answer) != 2 {
+		t.Errorf("allowed name was blocked by its cname: %v", w.msg)
+	}
+}
@@ -0,0 +1,213 @@
+package dns
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// weight of a new sample in the moving averages
+	ewmaAlpha = 0.3
+	// consecutive failures which open the circuit of a nameserver
+	maxFailures = 3
+)
+
+// NameserverStats reports the health of a nameserver
+type NameserverStats struct {
+	RTT         string  `json:"rtt"`
+	FailRate    float64 `json:"failrate"`
+	Queries     uint64  `json:"queries"`
+	Failures    uint64  `json:"failures"`
+	RcodeErrors uint64  `json:"rcodeErrors"`
+	Open        bool    `json:"open"`
+}
+
+// nsHealth tracks the health of one nameserver
+type nsHealth struct {
+	rtt         time.Duration // moving average of round trip time
+	failRate    float64       // moving average of failures
+	queries     uint64
+	failures    uint64
+	rcodeErrors uint64 // SERVFAIL and REFUSED answers, which don't open the circuit
+	consecutive int
+	open        bool // circuit is open, only probes are sent
+}
+
+// healthTable tracks the health of all nameservers
+type healthTable struct {
+	mu sync.RWMutex
+	ns map[string]*nsHealth
+}
+
+func newHealthTable() *healthTable {
+	return &healthTable{ns: make(map[string]*nsHealth)}
+}
+
+// get returns the health of nameserver, t.mu must be held for writing
+func (t *healthTable) get(nameserver string) *nsHealth {
+	h, ok := t.ns[nameserver]
+	if !ok {
+		h = &nsHealth{}
+		t.ns[nameserver] = h
+	}
+	return h
+}
+
+// Success records an answer from nameserver after rtt, and closes its circuit
+func (t *healthTable) Success(nameserver string, rtt time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	h := t.get(nameserver)
+	h.queries++
+	h.sample(rtt, 0)
+	h.consecutive = 0
+	if h.open {
+		h.open = false
+		log.Printf("nameserver %s is healthy again\n", nameserver)
+	}
+}
+
+// Failure records a failed exchange with nameserver, penalty is taken as its rtt
+func (t *healthTable) Failure(nameserver string, penalty time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	h := t.get(nameserver)
+	h.queries++
+	h.failures++
+	h.sample(penalty, 1)
+	h.consecutive++
+	if !h.open && h.consecutive >= maxFailures {
+		h.open = true
+		log.Printf("nameserver %s failed %d times, stop using it\n", nameserver, h.consecutive)
+	}
+}
+
+// RcodeError records an error answer from nameserver after rtt, such as
+// SERVFAIL for a broken domain, the nameserver itself is alive
+func (t *healthTable) RcodeError(nameserver string, rtt time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	h := t.get(nameserver)
+	h.queries++
+	h.rcodeErrors++
+	h.sample(rtt, 0)
+	h.consecutive = 0
+}
+
+func (h *nsHealth) sample(rtt time.Duration, failure float64) {
+	if h.queries == 1 {
+		h.rtt = rtt
+		h.failRate = failure
+		return
+	}
+	h.rtt += time.Duration(ewmaAlpha * float64(rtt-h.rtt))
+	h.failRate += ewmaAlpha * (failure - h.failRate)
+}
+
+// Order returns the healthy nameservers, fastest first. Nameservers without
+// samples keep their position before the measured ones, so they get a chance.
+// If every nameserver is unhealthy, all of them are returned in config order.
+func (t *healthTable) Order(nameservers []string) []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	ordered := make([]string, 0, len(nameservers))
+	for _, ns := range nameservers {
+		if h, ok := t.ns[ns]; !ok || !h.open {
+			ordered = append(ordered, ns)
+		}
+	}
+	if len(ordered) == 0 {
+		return nameservers
+	}
+
+	rtt := func(ns string) time.Duration {
+		if h, ok := t.ns[ns]; ok {
+			return h.rtt
+		}
+		return 0
+	}
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return rtt(ordered[i]) < rtt(ordered[j])
+	})
+	return ordered
+}
+
+// Unhealthy returns the nameservers with open circuit
+func (t *healthTable) Unhealthy() []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var nameservers []string
+	for ns, h := range t.ns {
+		if h.open {
+			nameservers = append(nameservers, ns)
+		}
+	}
+	return nameservers
+}
+
+// Stats returns the health of every nameserver which has been queried
+func (t *healthTable) Stats() map[string]NameserverStats {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	stats := make(map[string]NameserverStats, len(t.ns))
+	for ns, h := range t.ns {
+		stats[ns] = NameserverStats{
+			RTT:         h.rtt.String(),
+			FailRate:    h.failRate,
+			Queries:     h.queries,
+			Failures:    h.failures,
+			RcodeErrors: h.rcodeErrors,
+			Open:        h.open,
+		}
+	}
+	return stats
+}
+
+// Probe queries unhealthy nameservers every interval until stop is closed,
+// the circuit of a nameserver is closed again once it answers
+func (r *Resolver) Probe(interval time.Duration, stop <-chan struct{}) {
+	if interval <= 0 {
+		return
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(".", dns.TypeNS)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			for _, ns := range r.health.Unhealthy() {
+				go r.probe(ns, m.Copy())
+			}
+		}
+	}
+}
+
+func (r *Resolver) probe(nameserver string, m *dns.Msg) {
+	u, err := r.upstreams.Get(nameserver)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	m.Id = dns.Id()
+	_, rtt, err := u.Exchange("udp", m)
+	if err != nil {
+		log.Printf("probe nameserver %s failed: %s\n", nameserver, err)
+		return
+	}
+	r.health.Success(nameserver, rtt)
+}
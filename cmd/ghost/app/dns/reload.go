@@ -0,0 +1,101 @@
+package dns
+
+import (
+	"log"
+	"os"
+	"reflect"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// restartFields are the config fields which only take effect on restart,
+// they are used when the server, caches and background jobs are created
+var restartFields = []string{
+	"Bind", "Listen", "TLSBind", "TLSCert", "TLSKey", "HTTPSBind", "HTTPSCert", "HTTPSKey", "API",
+	"DataDir", "GeoIPSrc", "GeoIPName", "Timeout", "ProbeInterval", "ReloadInterval", "UpdateInterval",
+	"Expire", "FailureTTL", "MinTTL", "MaxTTL", "StaleWindow", "PrefetchWindow", "PrefetchHits",
+	"Maxcount", "CacheType", "CacheFile", "JanitorInterval", "FakeInterval",
+}
+
+// restartRequired returns the names of restartFields which differ between old and new
+func restartRequired(old, new *config) []string {
+	var changed []string
+	ov, nv := reflect.ValueOf(old).Elem(), reflect.ValueOf(new).Elem()
+	for _, name := range restartFields {
+		if !reflect.DeepEqual(ov.FieldByName(name).Interface(), nv.FieldByName(name).Interface()) {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// Reload reads the config file loaded by LoadConfig again and applies it
+// without touching the listeners: the config is swapped, the routes of the
+// resolver, the blocklist and the cold fake ips are rebuilt, and upstreams of
+// removed nameservers are closed. Changes which need a restart are logged.
+// The running config is kept if the file is invalid.
+func (s *Server) Reload() error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	c, err := readConfig(gConfigPath)
+	if err != nil {
+		return err
+	}
+
+	// blocklist files are parsed before anything is swapped, sources new to
+	// the config are downloaded, others are taken from datadir as is
+	blockCache := NewBlockList()
+	if err := loadBlocklists(c, blockCache, false, s.quit); err != nil {
+		return errors.Wrap(err, "failed to reload blocklists")
+	}
+
+	old := getConfig()
+	for _, name := range restartRequired(old, c) {
+		log.Printf("config %s changed, restart to apply it\n", name)
+	}
+
+	setConfig(c)
+	s.handler.resolver.SetRoutes(c.Routes)
+	// upstreams of removed nameservers would keep their connections
+	s.handler.resolver.upstreams.Prune(configNameservers(c))
+	gBlockCache.Replace(blockCache)
+	seedFakeIPs(old, c)
+
+	log.Printf("config %s reloaded\n", gConfigPath)
+
+	return nil
+}
+
+// Watch reloads the config file when its modification time changes, the
+// file is checked every interval until Shutdown is called
+func (s *Server) Watch(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	var modTime time.Time
+	if fi, err := os.Stat(gConfigPath); err == nil {
+		modTime = fi.ModTime()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			fi, err := os.Stat(gConfigPath)
+			if err != nil || fi.ModTime().Equal(modTime) {
+				continue
+			}
+			modTime = fi.ModTime()
+			if err := s.Reload(); err != nil {
+				log.Printf("failed to reload config: %s\n", err)
+			}
+		case <-s.quit:
+			return
+		}
+	}
+}
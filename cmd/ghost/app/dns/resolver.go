@@ -25,33 +25,61 @@ func (e ResolvError) Error() string {
 
 // Resolver type
 type Resolver struct {
+	mu        sync.RWMutex
+	routes    *routeTable
+	health    *healthTable
+	upstreams upstreamPool
+}
+
+// NewResolver returns a Resolver with routes from config
+func NewResolver() *Resolver {
+	return &Resolver{
+		routes: newRouteTable(getConfig().Routes),
+		health: newHealthTable(),
+	}
 }
 
 // Lookup will ask each nameserver in top-to-bottom fashion, starting a new request
 // in every second, and return as early as possbile (have an answer).
+// Questions matching a route only go to the nameservers of that route, others
+// to the nameservers of group if it is not empty.
 // It returns an error if no request has succeeded.
-func (r *Resolver) Lookup(net string, req *dns.Msg) (*dns.Msg, error) {
-	c := &dns.Client{
-		Net:          net,
-		ReadTimeout:  r.Timeout(),
-		WriteTimeout: r.Timeout(),
+func (r *Resolver) Lookup(net string, req *dns.Msg, group string) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.SessionTimeout())
+	defer cancel()
+
+	r.mu.RLock()
+	routes := r.routes
+	r.mu.RUnlock()
+
+	upstream, ok := routes.Match(req.Question[0].Name)
+	if !ok && group != "" {
+		upstream, ok = group, true
+	}
+	if ok {
+		nameservers := r.Group(upstream)
+		res := make(chan *dns.Msg, 1)
+		go r.lookupFromServer(ctx, net, nameservers, req, res)
+		if msg := <-res; msg != nil {
+			return msg, nil
+		}
+		return nil, ResolvError{UnFqdn(req.Question[0].Name), net, nameservers}
 	}
 
 	var gMsg, cMsg, iMsg *dns.Msg
 	var gRes, cRes, iRes chan *dns.Msg
-	ctx, _ := context.WithTimeout(context.Background(), r.SessionTimeout())
 
 	if len(r.Nameservers()) > 0 {
 		gRes = make(chan *dns.Msg, 1)
-		go lookupFromServer(ctx, c, r.Nameservers(), req, gRes)
+		go r.lookupFromServer(ctx, net, r.Nameservers(), req, gRes)
 	}
 	if len(r.CHNameservers()) > 0 {
 		cRes = make(chan *dns.Msg, 1)
-		go lookupFromServer(ctx, c, r.CHNameservers(), req, cRes)
+		go r.lookupFromServer(ctx, net, r.CHNameservers(), req, cRes)
 	}
 	if len(r.ISPNameservers()) > 0 {
 		iRes = make(chan *dns.Msg, 1)
-		go lookupFromServer(ctx, c, r.ISPNameservers(), req, iRes)
+		go r.lookupFromServer(ctx, net, r.ISPNameservers(), req, iRes)
 	}
 
 	for {
@@ -76,20 +104,29 @@ func (r *Resolver) Lookup(net string, req *dns.Msg) (*dns.Msg, error) {
 	return selectMsg(gMsg, cMsg, iMsg)
 }
 
-func lookupFromServer(ctx context.Context, c *dns.Client,
+// SetRoutes replaces the routes of the resolver, lookups in progress keep the old ones
+func (r *Resolver) SetRoutes(routes []route) {
+	t := newRouteTable(routes)
+
+	r.mu.Lock()
+	r.routes = t
+	r.mu.Unlock()
+}
+
+func (r *Resolver) lookupFromServer(ctx context.Context, net string,
 	nameservers []string, req *dns.Msg, res chan *dns.Msg) {
 	defer close(res)
 
 	msgChan := make(chan *dns.Msg, 1)
 	wg := &sync.WaitGroup{}
 
-	// Start lookup on each nameserver top-down, in every Interval millisecond
-	ticker := time.NewTicker(gConfig.Interval.Duration)
+	// Start lookup on each healthy nameserver fastest first, in every Interval millisecond
+	ticker := time.NewTicker(getConfig().Interval.Duration)
 	defer ticker.Stop()
 
-	for _, ns := range nameservers {
+	for _, ns := range r.health.Order(nameservers) {
 		wg.Add(1)
-		go doLookup(c, ns, req, msgChan, wg)
+		go r.doLookup(net, ns, req, msgChan, wg)
 		// but exit early, if we have an answer
 		select {
 		case <-ctx.Done():
@@ -119,33 +156,44 @@ func lookupFromServer(ctx context.Context, c *dns.Client,
 	}
 }
 
-func doLookup(c *dns.Client, nameserver string, req *dns.Msg,
+func (r *Resolver) doLookup(net string, nameserver string, req *dns.Msg,
 	res chan *dns.Msg, wg *sync.WaitGroup) {
 	defer wg.Done()
 
 	qname := UnFqdn(req.Question[0].Name)
 	log.Printf("lookuping %s on %s\n", qname, nameserver)
 
-	r, _, err := c.Exchange(req, nameserver)
+	u, err := r.upstreams.Get(nameserver)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	m, rtt, err := u.Exchange(net, req)
 	if err != nil {
 		log.Printf("failed to exchange with %s for %s: %s\n",
 			nameserver, qname, err)
+		r.health.Failure(nameserver, r.Timeout())
 		return
 	}
-	if r != nil && r.Rcode != dns.RcodeSuccess {
+	// NXDOMAIN is a valid answer, it is cached and returned to client as is
+	if m != nil && m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError {
 		log.Printf("get an invalid answer for %s on %s, rcode:%s\n",
-			qname, nameserver, dns.RcodeToString[r.Rcode])
+			qname, nameserver, dns.RcodeToString[m.Rcode])
+		// the nameserver answered, only transport failures open its circuit
+		r.health.RcodeError(nameserver, rtt)
+		return
+	}
+	r.health.Success(nameserver, rtt)
+	if checkFakeIP(m) {
+		log.Printf("resolved %s on %s hit fake ip cache\n", qname, nameserver)
 		return
-	} else {
-		if checkFakeIP(r) {
-			log.Printf("resolved %s on %s hit fake ip cache\n", qname, nameserver)
-			return
-		}
 	}
 
+	// only the first answer is used, later ones must not block
 	select {
-	case res <- r:
-		log.Printf("success to resolv %s on %s: %v\n", qname, nameserver, r)
+	case res <- m:
+		log.Printf("success to resolv %s on %s: %v\n", qname, nameserver, m)
+	default:
 	}
 }
 
@@ -155,6 +203,14 @@ func selectMsg(gMsg, cMsg, iMsg *dns.Msg) (*dns.Msg, error) {
 		return iMsg, nil
 	}
 
+	// a positive answer beats NXDOMAIN
+	if gMsg != nil && cMsg != nil && gMsg.Rcode != cMsg.Rcode {
+		if gMsg.Rcode == dns.RcodeSuccess {
+			return gMsg, nil
+		}
+		return cMsg, nil
+	}
+
 	// select between gMsg and cMsg
 	if gMsg == nil {
 		return cMsg, nil
@@ -187,37 +243,51 @@ func selectMsg(gMsg, cMsg, iMsg *dns.Msg) (*dns.Msg, error) {
 
 func (r *Resolver) AllNameservers() []string {
 	var ns []string
-	ns = append(ns, gConfig.Nameservers...)
-	ns = append(ns, gConfig.CHNameservers...)
-	ns = append(ns, gConfig.ISPNameservers...)
+	ns = append(ns, getConfig().Nameservers...)
+	ns = append(ns, getConfig().CHNameservers...)
+	ns = append(ns, getConfig().ISPNameservers...)
 	return ns
 }
 
 func (r *Resolver) NonISPNameservers() []string {
 	var ns []string
-	ns = append(ns, gConfig.Nameservers...)
-	ns = append(ns, gConfig.CHNameservers...)
+	ns = append(ns, getConfig().Nameservers...)
+	ns = append(ns, getConfig().CHNameservers...)
 	return ns
 }
 
 // Nameservers return the array of nameservers
 func (r *Resolver) Nameservers() []string {
-	return gConfig.Nameservers
+	return getConfig().Nameservers
 }
 
 func (r *Resolver) CHNameservers() []string {
-	return gConfig.CHNameservers
+	return getConfig().CHNameservers
 }
 
 func (r *Resolver) ISPNameservers() []string {
-	return gConfig.ISPNameservers
+	return getConfig().ISPNameservers
+}
+
+// Group returns the nameservers of a builtin or configured group
+func (r *Resolver) Group(name string) []string {
+	switch name {
+	case "nameservers":
+		return getConfig().Nameservers
+	case "chnameservers":
+		return getConfig().CHNameservers
+	case "ispnameservers":
+		return getConfig().ISPNameservers
+	default:
+		return getConfig().Upstreams[name]
+	}
 }
 
 // Timeout returns the resolver timeout
 func (r *Resolver) Timeout() time.Duration {
-	return gConfig.Timeout.Duration
+	return getConfig().Timeout.Duration
 }
 
 func (r *Resolver) SessionTimeout() time.Duration {
-	return gConfig.SessionTimeout.Duration
+	return getConfig().SessionTimeout.Duration
 }
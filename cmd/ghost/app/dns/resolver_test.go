@@ -1,7 +1,12 @@
 package dns
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
 )
@@ -23,3 +28,90 @@ func BenchmarkResolver(b *testing.B) {
 		c.Exchange(m, testNameserver)
 	}
 }
+
+func TestRouteTable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "china.conf")
+	content := "# comment\nserver=/baidu.com/114.114.114.114\nserver=/qq.com/weixin.com/114.114.114.114\nipset=/taobao.com/china\nsohu.com\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	table := newRouteTable([]route{
+		{Files: []string{path}, Upstream: "chnameservers"},
+		{Domains: []string{"example.com"}, Upstream: "nameservers"},
+		{Domains: []string{"corp.example.com."}, Upstream: "ispnameservers"},
+	})
+
+	cases := []struct {
+		qname    string
+		upstream string
+	}{
+		{"www.baidu.com.", "chnameservers"},
+		{"weixin.com.", "chnameservers"},
+		{"news.sohu.com.", "chnameservers"},
+		{"taobao.com.", ""},
+		{"WWW.Example.COM.", "nameservers"},
+		{"git.corp.example.com.", "ispnameservers"},
+		{"example.org.", ""},
+	}
+	for _, c := range cases {
+		if upstream, _ := table.Match(c.qname); upstream != c.upstream {
+			t.Errorf("%s: expected upstream %q, got %q", c.qname, c.upstream, upstream)
+		}
+	}
+}
+
+func TestHealthTable(t *testing.T) {
+	table := newHealthTable()
+	nameservers := []string{"a:53", "b:53", "c:53", "d:53"}
+
+	table.Success("a:53", 300*time.Millisecond)
+	table.Success("b:53", 20*time.Millisecond)
+	for i := 0; i < maxFailures; i++ {
+		table.Failure("c:53", time.Second)
+	}
+
+	// d has no samples so it goes first, c is dead
+	expected := []string{"d:53", "b:53", "a:53"}
+	if got := table.Order(nameservers); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected order %v, got %v", expected, got)
+	}
+	if got := table.Unhealthy(); !reflect.DeepEqual(got, []string{"c:53"}) {
+		t.Errorf("expected c:53 unhealthy, got %v", got)
+	}
+
+	table.Success("c:53", 10*time.Millisecond)
+	if len(table.Unhealthy()) != 0 {
+		t.Error("nameserver should be healthy after an answer")
+	}
+	if stats := table.Stats()["c:53"]; stats.Queries != 4 || stats.Failures != 3 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	// error answers of a live nameserver don't open its circuit
+	for i := 0; i < maxFailures; i++ {
+		table.RcodeError("a:53", 30*time.Millisecond)
+	}
+	if len(table.Unhealthy()) != 0 {
+		t.Error("nameserver should stay healthy after error answers")
+	}
+	if stats := table.Stats()["a:53"]; stats.RcodeErrors != maxFailures || stats.Failures != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	// every nameserver is dead, fall back to config order
+	for _, ns := range nameservers {
+		for i := 0; i < maxFailures; i++ {
+			table.Failure(ns, time.Second)
+		}
+	}
+	if got := table.Order(nameservers); !reflect.DeepEqual(got, nameservers) {
+		t.Errorf("expected config order %v, got %v", nameservers, got)
+	}
+}
@@ -0,0 +1,113 @@
+package dns
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// route sends queries for Domains, and domains listed in Files, to the
+// nameserver group named Upstream
+type route struct {
+	Domains  []string
+	Files    []string
+	Upstream string
+}
+
+// routeTable maps domain suffixes to nameserver group names
+type routeTable struct {
+	domains map[string]string
+}
+
+// newRouteTable builds a routeTable from routes, domains of later routes
+// override earlier ones
+func newRouteTable(routes []route) *routeTable {
+	t := &routeTable{domains: make(map[string]string)}
+	for _, r := range routes {
+		for _, domain := range r.Domains {
+			t.add(domain, r.Upstream)
+		}
+		for _, path := range r.Files {
+			domains, err := parseRouteFile(path)
+			if err != nil {
+				log.Printf("failed to load route file: %s\n", err)
+				continue
+			}
+			for _, domain := range domains {
+				t.add(domain, r.Upstream)
+			}
+			log.Printf("%d domains routed to %s from %s\n", len(domains), r.Upstream, path)
+		}
+	}
+	return t
+}
+
+func (t *routeTable) add(domain, upstream string) {
+	domain = strings.ToLower(UnFqdn(strings.TrimSpace(domain)))
+	if domain != "" {
+		t.domains[domain] = upstream
+	}
+}
+
+// Match returns the group of the most specific route for qname
+func (t *routeTable) Match(qname string) (string, bool) {
+	name := strings.ToLower(UnFqdn(qname))
+	for {
+		if upstream, ok := t.domains[name]; ok {
+			return upstream, true
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			return "", false
+		}
+		name = name[i+1:]
+	}
+}
+
+// Length returns the number of routed domains
+func (t *routeTable) Length() int {
+	return len(t.domains)
+}
+
+// parseRouteFile reads domains from a file, with one domain per line or
+// dnsmasq rules like "server=/example.com/114.114.114.114"
+func parseRouteFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open route file: %s", path)
+	}
+	defer file.Close()
+
+	var domains []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if !strings.HasPrefix(line, "server=/") {
+			// other dnsmasq options don't route anything
+			if !strings.Contains(line, "=") {
+				domains = append(domains, strings.Fields(line)[0])
+			}
+			continue
+		}
+
+		// server=/domain1/domain2/nameserver
+		fields := strings.Split(strings.TrimPrefix(line, "server=/"), "/")
+		for _, domain := range fields[:len(fields)-1] {
+			if domain != "" {
+				domains = append(domains, domain)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "failed to scan route file: %s", path)
+	}
+
+	return domains, nil
+}
@@ -0,0 +1,136 @@
+package dns
+
+import (
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// policy actions of response policy zone rules, filter rules have none and
+// are answered in the block mode
+const (
+	rpzNone = iota
+	rpzNXDOMAIN
+	rpzNODATA
+	rpzDrop
+	rpzLocal
+)
+
+// parseRPZ adds the QNAME triggers of a response policy zone file to cache,
+// the zone is the owner of its SOA record. Triggers are "name" for the name
+// and "*.name" for its subdomains, with the actions
+//
+//	CNAME .               NXDOMAIN
+//	CNAME *.              NODATA
+//	CNAME rpz-passthru.   PASSTHRU, an exception
+//	CNAME rpz-drop.       DROP, no answer at all
+//	other records         local data, which is answered instead
+//
+// Other triggers and actions are skipped, source and category are recorded in
+// each rule. It returns the number of rules added and the number of records skipped.
+func parseRPZ(path, source, category string, cache *BlockList) (int, int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "failed to open response policy zone: %s", path)
+	}
+	defer file.Close()
+
+	var rules []*BlockRule
+	owners := make(map[string]*BlockRule)
+	origin, suffix := "", ""
+	skipped := 0
+	for token := range dns.ParseZone(file, ".", path) {
+		// the zone is read to the end even after an error, to let the parser finish
+		if token.Error != nil || err != nil {
+			if err == nil {
+				err = token.Error
+			}
+			continue
+		}
+		rr := token.RR
+		owner := strings.ToLower(rr.Header().Name)
+		if origin == "" {
+			if rr.Header().Rrtype != dns.TypeSOA {
+				err = errors.New("no SOA at the start of the zone")
+				continue
+			}
+			origin, suffix = owner, "."+owner
+			if owner == "." {
+				suffix = "."
+			}
+			continue
+		}
+		if owner == origin || !strings.HasSuffix(owner, suffix) {
+			// NS records of the zone, and records out of it
+			continue
+		}
+		name := strings.TrimSuffix(owner, suffix)
+
+		if r, ok := owners[name]; ok {
+			// more records of a local data rule
+			if r.action == rpzLocal && rr.Header().Rrtype != dns.TypeCNAME {
+				r.records = append(r.records, rr)
+			} else {
+				skipped++
+			}
+			continue
+		}
+
+		r, ok := rpzRule(name, rr)
+		if !ok {
+			skipped++
+			continue
+		}
+		r.Source, r.Category, r.Text = source, category, rr.String()
+		owners[name] = r
+		rules = append(rules, r)
+	}
+	if err != nil {
+		return 0, skipped, errors.Wrapf(err, "failed to parse response policy zone: %s", path)
+	}
+
+	for _, r := range rules {
+		cache.Add(r)
+	}
+	return len(rules), skipped, nil
+}
+
+// rpzTriggers are the labels of the triggers other than QNAME
+var rpzTriggers = map[string]bool{"rpz-ip": true, "rpz-nsdname": true, "rpz-nsip": true, "rpz-client-ip": true}
+
+// rpzRule returns the rule of the first record of a trigger name
+func rpzRule(name string, rr dns.RR) (*BlockRule, bool) {
+	r := &BlockRule{name: name}
+	if strings.HasPrefix(name, "*.") {
+		r.name, r.subdomains, r.subOnly = name[2:], true, true
+	}
+	// rpz-ip, rpz-nsdname, rpz-nsip and rpz-client-ip triggers, which end
+	// with their label
+	if rpzTriggers[r.name[strings.LastIndexByte(r.name, '.')+1:]] || !domainPattern.MatchString(r.name) {
+		return nil, false
+	}
+
+	cname, ok := rr.(*dns.CNAME)
+	if !ok {
+		r.action, r.records = rpzLocal, []dns.RR{rr}
+		return r, true
+	}
+	switch target := strings.ToLower(cname.Target); {
+	case target == ".":
+		r.action = rpzNXDOMAIN
+	case target == "*.":
+		r.action = rpzNODATA
+	case target == "rpz-passthru.":
+		r.allow = true
+	case target == "rpz-drop.":
+		r.action = rpzDrop
+	case strings.HasPrefix(target, "rpz-"):
+		// rpz-tcp-only and unknown actions
+		return nil, false
+	default:
+		r.action, r.records = rpzLocal, []dns.RR{rr}
+	}
+	return r, true
+}
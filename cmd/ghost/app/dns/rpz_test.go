@@ -0,0 +1,103 @@
+package dns
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const testZone = `$TTL 300
+$ORIGIN rpz.example.org.
+@ SOA localhost. root.localhost. 1 3600 600 86400 300
+  NS localhost.
+nx.example.com CNAME .
+*.nx.example.com CNAME .
+ok.nx.example.com CNAME rpz-passthru.
+nodata.example.com CNAME *.
+*.drop.example.com CNAME rpz-drop.
+local.example.com A 10.0.0.1
+local.example.com A 10.0.0.2
+local.example.com TXT "blocked"
+walled.example.com CNAME garden.example.net.
+tcp.example.com CNAME rpz-tcp-only.
+32.1.0.0.10.rpz-ip CNAME .
+ns.example.com.rpz-nsdname CNAME .
+my-rpz-site.com CNAME .
+`
+
+func TestParseRPZ(t *testing.T) {
+	f, err := ioutil.TempFile("", "rpz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(testZone)
+	f.Close()
+
+	b := NewBlockList()
+	added, skipped, err := parseRPZ(f.Name(), "zone", "", b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 8 || skipped != 3 {
+		t.Errorf("expected 8 rules and 3 skipped, got %d and %d", added, skipped)
+	}
+
+	defer setConfig(getConfig())
+	setConfig(&config{BlockMode: "ip", Nullroute: "0.0.0.0", TTL: 10})
+	h := &DNSHandler{}
+	for _, c := range []struct {
+		name    string
+		qtype   uint16
+		blocked bool
+		rcode   int
+		answers int
+	}{
+		{"nx.example.com", dns.TypeA, true, dns.RcodeNameError, 0},
+		{"www.nx.example.com", dns.TypeA, true, dns.RcodeNameError, 0},
+		{"ok.nx.example.com", dns.TypeA, false, 0, 0},
+		{"nodata.example.com", dns.TypeA, true, dns.RcodeSuccess, 0},
+		{"www.nodata.example.com", dns.TypeA, false, 0, 0},
+		{"drop.example.com", dns.TypeA, false, 0, 0},
+		{"www.drop.example.com", dns.TypeA, true, -1, 0},
+		{"local.example.com", dns.TypeA, true, dns.RcodeSuccess, 2},
+		{"local.example.com", dns.TypeTXT, true, dns.RcodeSuccess, 1},
+		{"local.example.com", dns.TypeMX, true, dns.RcodeSuccess, 0},
+		{"walled.example.com", dns.TypeA, true, dns.RcodeSuccess, 1},
+		{"tcp.example.com", dns.TypeA, false, 0, 0},
+		{"my-rpz-site.com", dns.TypeA, true, dns.RcodeNameError, 0},
+	} {
+		r := b.Lookup(c.name, c.qtype, nil)
+		if blocked := r != nil && r.Blocks(); blocked != c.blocked {
+			t.Errorf("%s %s: expected blocked %v, got %v", c.name, dns.TypeToString[c.qtype], c.blocked, blocked)
+			continue
+		}
+		if !c.blocked {
+			continue
+		}
+		if r.Source != "zone" || r.Text == "" {
+			t.Errorf("%s: unexpected attribution %+v", c.name, r)
+		}
+
+		req := new(dns.Msg)
+		req.SetQuestion(dns.Fqdn(c.name), c.qtype)
+		m := h.blockMsg(req, r)
+		if c.rcode < 0 {
+			if m != nil {
+				t.Errorf("%s: expected no answer, got %v", c.name, m)
+			}
+			continue
+		}
+		if m.Rcode != c.rcode || len(m.Answer) != c.answers {
+			t.Errorf("%s %s: expected rcode %s with %d answers, got %v", c.name, dns.TypeToString[c.qtype],
+				dns.RcodeToString[c.rcode], c.answers, m)
+		}
+		for _, rr := range m.Answer {
+			if rr.Header().Name != req.Question[0].Name {
+				t.Errorf("%s: local data should be answered for the question name, got %s", c.name, rr)
+			}
+		}
+	}
+}
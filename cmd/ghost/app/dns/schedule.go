@@ -0,0 +1,189 @@
+package dns
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// schedule is a [[schedules]] table of the config, which blocks with the
+// lists of Categories during a daily time window
+type schedule struct {
+	Name       string
+	Groups     []string // client groups, all clients when empty
+	Categories []string
+	Days       []string // "mon" to "sun", every day when empty
+	Start      string   // "21:00"
+	End        string   // "07:00", a window ending before it starts ends the next day
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// clientSchedule is a schedule compiled for evaluation
+type clientSchedule struct {
+	name       string
+	groups     map[string]bool // nil for all clients
+	categories []string
+	days       [7]bool
+	start, end int // minutes since midnight
+}
+
+// parseSchedules compiles the schedules of c
+func parseSchedules(c *config) ([]*clientSchedule, error) {
+	groups := make(map[string]bool)
+	for _, g := range c.Groups {
+		groups[g.Name] = true
+	}
+
+	var schedules []*clientSchedule
+	for _, sc := range c.Schedules {
+		s := &clientSchedule{name: sc.Name, categories: sc.Categories}
+		if len(sc.Categories) == 0 {
+			return nil, errors.Errorf("no categories in schedule %s", sc.Name)
+		}
+		for _, category := range sc.Categories {
+			if _, ok := c.Categories[category]; !ok {
+				return nil, errors.Errorf("unknown category %s in schedule %s", category, sc.Name)
+			}
+		}
+		for _, name := range sc.Groups {
+			if !groups[name] {
+				return nil, errors.Errorf("unknown group %s in schedule %s", name, sc.Name)
+			}
+			if s.groups == nil {
+				s.groups = make(map[string]bool)
+			}
+			s.groups[name] = true
+		}
+
+		for _, day := range sc.Days {
+			wd, ok := weekdays[strings.ToLower(day)]
+			if !ok {
+				return nil, errors.Errorf("unknown day %s in schedule %s", day, sc.Name)
+			}
+			s.days[wd] = true
+		}
+		if len(sc.Days) == 0 {
+			s.days = [7]bool{true, true, true, true, true, true, true}
+		}
+
+		var err error
+		if s.start, err = parseClock(sc.Start); err != nil {
+			return nil, errors.Wrapf(err, "invalid start of schedule %s", sc.Name)
+		}
+		if s.end, err = parseClock(sc.End); err != nil {
+			return nil, errors.Wrapf(err, "invalid end of schedule %s", sc.Name)
+		}
+		schedules = append(schedules, s)
+	}
+	return schedules, nil
+}
+
+// parseClock parses a "15:04" time of day into minutes since midnight, an
+// empty time is midnight
+func parseClock(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// active reports whether the window of the schedule is open at t, a window
+// which ends before it starts runs from its start on a scheduled day to its
+// end on the next day, and one which ends when it starts lasts all day
+func (s *clientSchedule) active(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	switch {
+	case s.start == s.end:
+		return s.days[day]
+	case s.start < s.end:
+		return s.days[day] && minute >= s.start && minute < s.end
+	case minute >= s.start:
+		return s.days[day]
+	case minute < s.end:
+		return s.days[(day+6)%7]
+	}
+	return false
+}
+
+// applies reports whether the schedule covers the clients of group
+func (s *clientSchedule) applies(group *clientGroup) bool {
+	return s.groups == nil || s.groups[group.Name()]
+}
+
+// activeCategories returns the categories blocked for the clients of group
+// at t, or nil if there are none
+func (c *config) activeCategories(group *clientGroup, t time.Time) map[string]bool {
+	var active map[string]bool
+	for _, s := range c.schedules {
+		if !s.applies(group) || !s.active(t) {
+			continue
+		}
+		if active == nil {
+			active = make(map[string]bool)
+		}
+		for _, category := range s.categories {
+			active[category] = true
+		}
+	}
+	return active
+}
+
+// categoryOf returns the category of the list uri, or "" if it has none
+func categoryOf(c *config, uri string) string {
+	for category, uris := range c.Categories {
+		for _, u := range uris {
+			if u == uri {
+				return category
+			}
+		}
+	}
+	return ""
+}
+
+// validateCategories checks that no list is in more than one category
+func validateCategories(c *config) error {
+	seen := make(map[string]string)
+	for category, uris := range c.Categories {
+		for _, uri := range uris {
+			if other, ok := seen[uri]; ok && other != category {
+				return errors.Errorf("list %s is in categories %s and %s", uri, other, category)
+			}
+			seen[uri] = category
+		}
+	}
+	return nil
+}
+
+// ScheduleStatus reports the current state of a schedule
+type ScheduleStatus struct {
+	Name       string   `json:"name"`
+	Groups     []string `json:"groups,omitempty"`
+	Categories []string `json:"categories"`
+	Active     bool     `json:"active"`
+}
+
+// ScheduleStatuses returns the state of the schedules of the current config
+func ScheduleStatuses() []ScheduleStatus {
+	now := time.Now()
+	var statuses []ScheduleStatus
+	for _, s := range getConfig().schedules {
+		status := ScheduleStatus{Name: s.name, Categories: s.categories, Active: s.active(now)}
+		for name := range s.groups {
+			status.Groups = append(status.Groups, name)
+		}
+		sort.Strings(status.Groups)
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
@@ -0,0 +1,118 @@
+package dns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/miekg/dns"
+)
+
+const testSchedules = `
+[categories]
+social = ["https://example.org/social.txt"]
+gaming = ["https://example.org/gaming.txt"]
+
+[[groups]]
+name = "kids"
+clients = ["192.168.1.32/28"]
+
+[[schedules]]
+name = "bedtime"
+groups = ["kids"]
+categories = ["social", "gaming"]
+days = ["mon", "tue", "wed", "thu", "fri"]
+start = "21:00"
+end = "07:00"
+
+[[schedules]]
+name = "homework"
+categories = ["gaming"]
+days = ["sat"]
+start = "14:00"
+end = "16:00"
+`
+
+func TestSchedules(t *testing.T) {
+	var c config
+	if _, err := toml.Decode(testSchedules, &c); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateConfig(&c); err != nil {
+		t.Fatal(err)
+	}
+	c.groups, _ = parseGroups(&c)
+	c.schedules, _ = parseSchedules(&c)
+	kids, other := c.groups[0], c.groups[1]
+
+	// 2017-01-02 is a Monday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2017, 1, day, hour, minute, 0, 0, time.Local)
+	}
+	cases := []struct {
+		group  *clientGroup
+		t      time.Time
+		social bool
+		gaming bool
+	}{
+		{kids, at(2, 20, 59), false, false},
+		{kids, at(2, 21, 0), true, true},
+		{kids, at(3, 6, 59), true, true},  // Monday night
+		{kids, at(3, 7, 0), false, false}, // Tuesday morning
+		{kids, at(2, 6, 0), false, false}, // Sunday night is not scheduled
+		{kids, at(7, 6, 0), true, true},   // Friday night
+		{kids, at(7, 15, 0), false, true}, // Saturday homework
+		{other, at(2, 22, 0), false, false},
+		{other, at(7, 15, 0), false, true},
+	}
+	for _, tc := range cases {
+		active := c.activeCategories(tc.group, tc.t)
+		if active["social"] != tc.social || active["gaming"] != tc.gaming {
+			t.Errorf("group %q at %s: unexpected categories %v", tc.group.Name(), tc.t, active)
+		}
+	}
+
+	// category lists are not excluded by groups, schedules decide
+	if !kids.uses("https://example.org/social.txt") || !other.uses("https://example.org/social.txt") {
+		t.Error("category lists should be used by all groups")
+	}
+
+	invalid := []schedule{
+		{Name: "none"},
+		{Name: "unknown", Categories: []string{"news"}},
+		{Name: "group", Categories: []string{"social"}, Groups: []string{"adults"}},
+		{Name: "day", Categories: []string{"social"}, Days: []string{"monday"}},
+		{Name: "time", Categories: []string{"social"}, Start: "25:00"},
+	}
+	for _, s := range invalid {
+		c.Schedules = []schedule{s}
+		if err := validateConfig(&c); err == nil {
+			t.Errorf("invalid schedule %s was accepted", s.Name)
+		}
+	}
+	c.Schedules = nil
+	c.Categories["news"] = []string{"https://example.org/social.txt"}
+	if err := validateConfig(&c); err == nil {
+		t.Error("list in two categories was accepted")
+	}
+}
+
+func TestCategoryLookup(t *testing.T) {
+	b := NewBlockList()
+	b.AddRule("||ads.example.com^", "easylist", 1)
+	r := &BlockRule{Source: "social", Category: "social", name: "facebook.com", subdomains: true}
+	b.Add(r)
+
+	if b.lookup("www.facebook.com", dns.TypeA, nil, nil, nil) != nil {
+		t.Error("category rule should not block without schedule")
+	}
+	if b.lookup("www.facebook.com", dns.TypeA, nil, nil, map[string]bool{"gaming": true}) != nil {
+		t.Error("category rule should not block for another category")
+	}
+	if b.lookup("www.facebook.com", dns.TypeA, nil, nil, map[string]bool{"social": true}) != r {
+		t.Error("category rule should block while its category is active")
+	}
+	if b.lookup("ads.example.com", dns.TypeA, nil, nil, nil) == nil {
+		t.Error("rules without category should always block")
+	}
+}
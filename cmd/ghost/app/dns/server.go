@@ -1,58 +1,319 @@
 package dns
 
 import (
+	"context"
+	"crypto/tls"
 	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/ensonmj/ghost/util"
 	"github.com/miekg/dns"
+	"github.com/pkg/errors"
 )
 
+// Listener is an address to listen on with its protocols, which are "udp",
+// "tcp", "tcp-tls" (DNS over TLS) and "https" (DNS over HTTPS). The host of
+// Addr can be an ip address or a network interface name, which listens on
+// every address of the interface.
+type Listener struct {
+	Addr string
+	Net  []string
+}
+
 // Server type
 type Server struct {
-	host     string
-	rTimeout time.Duration
-	wTimeout time.Duration
+	listeners []Listener
+	rTimeout  time.Duration
+	wTimeout  time.Duration
+	handler   *DNSHandler
+
+	dnsServers  []*dns.Server
+	dnsClosers  []func() error // close the sockets of dnsServers which never started
+	httpServers []*http.Server
+	apiServer   *http.Server
+	draining    chan struct{} // closed when udp listeners stop reading queries
+	quit        chan struct{}
+	reloadMu    sync.Mutex
 }
 
-func NewServer(rTimeout, wTimeout time.Duration) *Server {
+func NewServer(listeners []Listener, rTimeout, wTimeout time.Duration) *Server {
 	return &Server{
-		host:     gConfig.Bind,
-		rTimeout: rTimeout,
-		wTimeout: wTimeout,
+		listeners: listeners,
+		rTimeout:  rTimeout,
+		wTimeout:  wTimeout,
+		handler:   NewHandler(),
+		draining:  make(chan struct{}),
+		quit:      make(chan struct{}),
 	}
 }
 
-// Run starts the server
-func (s *Server) AsyRun() {
-	handler := NewHandler()
+// AsyRun binds all listeners and serves them in background, it returns an
+// error and closes everything opened if any listener can't be bound
+func (s *Server) AsyRun() error {
+	var closers []func() error
+	var serves []func()
+	fail := func(err error) error {
+		for _, c := range closers {
+			c()
+		}
+		return err
+	}
 
-	tcpHandler := dns.NewServeMux()
-	tcpHandler.HandleFunc(".", handler.DoTCP)
+	for _, l := range s.listeners {
+		addrs, err := expandAddr(l.Addr)
+		if err != nil {
+			return fail(err)
+		}
 
-	udpHandler := dns.NewServeMux()
-	udpHandler.HandleFunc(".", handler.DoUDP)
+		for _, addr := range addrs {
+			for _, network := range l.Net {
+				ln, pc, err := s.listen(network, addr)
+				if err != nil {
+					return fail(errors.Wrapf(err, "failed to start %s listener on %s", network, addr))
+				}
+				if pc != nil {
+					closers = append(closers, pc.Close)
+				} else {
+					closers = append(closers, ln.Close)
+				}
+				serves = append(serves, s.serve(network, addr, ln, pc))
+			}
+		}
+	}
 
-	tcpServer := &dns.Server{Addr: s.host,
-		Net:          "tcp",
-		Handler:      tcpHandler,
-		ReadTimeout:  s.rTimeout,
-		WriteTimeout: s.wTimeout}
+	for _, serve := range serves {
+		go serve()
+	}
+	// cold fake ips are used even when discovery is disabled
+	seedFakeIPs(nil, getConfig())
+	if getConfig().FakeInterval.Duration > 0 {
+		go UpdateFakeIP("114.114.114.114:53", s.quit)
+	}
+	go s.Watch(getConfig().ReloadInterval.Duration)
+	go s.UpdateData(getConfig().UpdateInterval.Duration)
+
+	return nil
+}
+
+// Shutdown stops all listeners, waits for in-flight queries, stops the API
+// server and background jobs, and flushes persistent state. In-flight queries
+// are abandoned when ctx is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	stop := func(i int, ds *dns.Server) {
+		if err := ds.Shutdown(); err != nil {
+			log.Printf("failed to stop %s listener on %s: %s\n", ds.Net, ds.Addr, err)
+			s.dnsClosers[i]()
+		}
+	}
+
+	// udp listeners only stop reading, in-flight queries reply on their
+	// socket, which is closed once they are done
+	close(s.draining)
+	for i, ds := range s.dnsServers {
+		if ds.PacketConn != nil {
+			// wake up a pending read, drainReader takes over
+			ds.PacketConn.SetReadDeadline(time.Now())
+			continue
+		}
+		stop(i, ds)
+	}
+	for _, hs := range s.httpServers {
+		if err := hs.Shutdown(ctx); err != nil {
+			log.Printf("failed to stop https listener on %s: %s\n", hs.Addr, err)
+		}
+	}
+
+	if err := s.handler.Wait(ctx); err != nil {
+		log.Printf("abandon in-flight queries: %s\n", err)
+	}
+	for i, ds := range s.dnsServers {
+		if ds.PacketConn != nil {
+			stop(i, ds)
+		}
+	}
+
+	if s.apiServer != nil {
+		if err := s.apiServer.Shutdown(ctx); err != nil {
+			log.Printf("failed to stop API server: %s\n", err)
+		}
+	}
+
+	close(s.quit)
+	s.handler.Close()
+
+	return s.handler.Flush()
+}
+
+// closing reports whether Shutdown has been called
+func (s *Server) closing() bool {
+	select {
+	case <-s.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// drainReader reads udp queries until the server drains, then waits for it
+// to quit, which leaves the socket open for the replies of in-flight queries
+type drainReader struct {
+	dns.Reader
+	s *Server
+}
 
-	udpServer := &dns.Server{Addr: s.host,
-		Net:          "udp",
-		Handler:      udpHandler,
+// ReadUDP implements dns.Reader
+func (r drainReader) ReadUDP(conn *net.UDPConn, timeout time.Duration) ([]byte, *dns.SessionUDP, error) {
+	select {
+	case <-r.s.draining:
+		<-r.s.quit
+		return nil, nil, errors.New("server is shutting down")
+	default:
+	}
+	return r.Reader.ReadUDP(conn, timeout)
+}
+
+// listen binds addr for network, udp returns a PacketConn, others a Listener
+func (s *Server) listen(network, addr string) (net.Listener, net.PacketConn, error) {
+	switch network {
+	case "udp":
+		pc, err := net.ListenPacket("udp", addr)
+		return nil, pc, err
+	case "tcp":
+		ln, err := net.Listen("tcp", addr)
+		return ln, nil, err
+	case "tcp-tls":
+		tlsConfig, err := loadTLSConfig(getConfig().TLSCert, getConfig().TLSKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		ln, err := tls.Listen("tcp", addr, tlsConfig)
+		return ln, nil, err
+	case "https":
+		tlsConfig, err := loadTLSConfig(getConfig().HTTPSCert, getConfig().HTTPSKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+		ln, err := tls.Listen("tcp", addr, tlsConfig)
+		return ln, nil, err
+	default:
+		return nil, nil, errors.Errorf("unknown protocol %s", network)
+	}
+}
+
+// serve returns a function serving queries of network from ln or pc
+func (s *Server) serve(network, addr string, ln net.Listener, pc net.PacketConn) func() {
+	if network == "https" {
+		mux := http.NewServeMux()
+		mux.Handle("/dns-query", s.handler)
+		hs := &http.Server{
+			Addr:         addr,
+			Handler:      mux,
+			ReadTimeout:  s.rTimeout,
+			WriteTimeout: s.wTimeout,
+		}
+		s.httpServers = append(s.httpServers, hs)
+
+		return func() {
+			log.Printf("start https listener on %s\n", addr)
+			if err := hs.Serve(ln); err != nil && err != http.ErrServerClosed {
+				log.Printf("https listener on %s failed: %s\n", addr, err.Error())
+			}
+		}
+	}
+
+	mux := dns.NewServeMux()
+	switch network {
+	case "udp":
+		mux.HandleFunc(".", s.handler.DoUDP)
+	case "tcp":
+		mux.HandleFunc(".", s.handler.DoTCP)
+	case "tcp-tls":
+		mux.HandleFunc(".", s.handler.DoTLS)
+	}
+	ds := &dns.Server{Addr: addr,
+		Net:          network,
+		Listener:     ln,
+		PacketConn:   pc,
+		Handler:      mux,
 		UDPSize:      65535,
 		ReadTimeout:  s.rTimeout,
 		WriteTimeout: s.wTimeout}
+	s.dnsServers = append(s.dnsServers, ds)
+	if pc != nil {
+		ds.DecorateReader = func(r dns.Reader) dns.Reader { return drainReader{r, s} }
+		s.dnsClosers = append(s.dnsClosers, pc.Close)
+	} else {
+		s.dnsClosers = append(s.dnsClosers, ln.Close)
+	}
 
-	go s.start(udpServer)
-	go s.start(tcpServer)
+	return func() {
+		log.Printf("start %s listener on %s\n", network, addr)
+		if err := ds.ActivateAndServe(); err != nil && !s.closing() {
+			log.Printf("%s listener on %s failed: %s\n", network, addr, err.Error())
+		}
+	}
 }
 
-func (s *Server) start(ds *dns.Server) {
-	log.Printf("start %s listener on %s\n", ds.Net, s.host)
+// expandAddr returns addr itself, or the addresses of a network interface
+// when the host of addr is an interface name
+func expandAddr(addr string) ([]string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid listen address: %s", addr)
+	}
+	if host == "" || net.ParseIP(strings.SplitN(host, "%", 2)[0]) != nil {
+		return []string{addr}, nil
+	}
+
+	iface, err := net.InterfaceByName(host)
+	if err != nil {
+		// a host name, which is resolved by net.Listen
+		return []string{addr}, nil
+	}
+	ifAddrs, err := iface.Addrs()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get addresses of interface: %s", host)
+	}
+
+	var addrs []string
+	for _, a := range ifAddrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip := ipnet.IP.String()
+		if ipnet.IP.IsLinkLocalUnicast() {
+			ip += "%" + iface.Name
+		}
+		addrs = append(addrs, net.JoinHostPort(ip, port))
+	}
+	if len(addrs) == 0 {
+		return nil, errors.Errorf("interface %s has no address", host)
+	}
+	return addrs, nil
+}
+
+// loadTLSConfig loads a certificate and its key, a self-signed certificate
+// is generated when neither of them exists
+func loadTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+	if os.IsNotExist(certErr) && os.IsNotExist(keyErr) {
+		log.Printf("generate self-signed certificate %s\n", certFile)
+		if err := util.CreateCertificate(certFile, keyFile, "localhost", "127.0.0.1", "::1"); err != nil {
+			return nil, errors.Wrap(err, "failed to generate certificate")
+		}
+	}
 
-	if err := ds.ListenAndServe(); err != nil {
-		log.Printf("start %s listener on %s failed: %s\n", ds.Net, s.host, err.Error())
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load certificate")
 	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
 }
@@ -0,0 +1,234 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestServerBindFailure(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	free, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	freeAddr := free.LocalAddr().String()
+	free.Close()
+
+	s := NewServer([]Listener{
+		{freeAddr, []string{"udp"}},
+		{busy.Addr().String(), []string{"tcp"}},
+	}, time.Second, time.Second)
+	defer s.handler.Close()
+
+	if err := s.AsyRun(); err == nil {
+		t.Fatal("binding a busy address should fail")
+	}
+
+	// the udp listener opened before the failure is closed again
+	pc, err := net.ListenPacket("udp", freeAddr)
+	if err != nil {
+		t.Errorf("listener was not closed after failure: %s", err)
+	} else {
+		pc.Close()
+	}
+}
+
+func TestExpandAddr(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:53", "[::1]:53", ":53", "localhost:53"} {
+		addrs, err := expandAddr(addr)
+		if err != nil || len(addrs) != 1 || addrs[0] != addr {
+			t.Errorf("%s: expected itself, got %v %v", addr, addrs, err)
+		}
+	}
+
+	ifaces, _ := net.Interfaces()
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback == 0 {
+			continue
+		}
+		addrs, err := expandAddr(iface.Name + ":53")
+		if err != nil || len(addrs) == 0 {
+			t.Errorf("%s: expected interface addresses, got %v %v", iface.Name, addrs, err)
+		}
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	// an upstream which answers after a while
+	received := make(chan struct{}, 1)
+	upstream := &dns.Server{Addr: "127.0.0.1:0", Net: "udp", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		received <- struct{}{}
+		time.Sleep(200 * time.Millisecond)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		a, _ := dns.NewRR(req.Question[0].Name + " 300 IN A 192.0.2.1")
+		m.Answer = []dns.RR{a}
+		w.WriteMsg(m)
+	})}
+	started := make(chan struct{})
+	upstream.NotifyStartedFunc = func() { close(started) }
+	go upstream.ListenAndServe()
+	<-started
+	defer upstream.Shutdown()
+
+	defer setConfig(getConfig())
+	setConfig(&config{
+		FakeIps:        []string{"192.0.2.54"},
+		Nameservers:    []string{upstream.PacketConn.LocalAddr().String()},
+		Interval:       duration{time.Second},
+		Timeout:        duration{time.Second},
+		SessionTimeout: duration{2 * time.Second},
+	})
+	defer gFakeIPCache.Remove("192.0.2.54")
+
+	s := NewServer([]Listener{{"127.0.0.1:0", []string{"udp", "tcp"}}}, time.Second, time.Second)
+	if err := s.AsyRun(); err != nil {
+		t.Fatal(err)
+	}
+	// cold fake ips are used with discovery disabled too
+	if !gFakeIPCache.Exists("192.0.2.54") {
+		t.Error("cold fake ips were not added")
+	}
+
+	// a udp query in flight when shutdown starts is still answered
+	var addr string
+	for _, ds := range s.dnsServers {
+		if ds.PacketConn != nil {
+			addr = ds.PacketConn.LocalAddr().String()
+		}
+	}
+	reply := make(chan *dns.Msg, 1)
+	go func() {
+		req := new(dns.Msg)
+		req.SetQuestion("www.example.com.", dns.TypeA)
+		c := &dns.Client{Net: "udp", Timeout: 2 * time.Second}
+		m, _, err := c.Exchange(req, addr)
+		if err != nil {
+			t.Errorf("in-flight query failed: %s", err)
+		}
+		reply <- m
+	}()
+	select {
+	case <-received:
+	case <-time.After(2 * time.Second):
+		t.Fatal("query did not reach the upstream")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-reply:
+		if m == nil || len(m.Answer) != 1 {
+			t.Errorf("unexpected answer to in-flight query: %v", m)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("in-flight query was not answered")
+	}
+
+	// the sockets are closed, even of listeners stopped before they started
+	for _, ds := range s.dnsServers {
+		if ds.PacketConn != nil {
+			pc, err := net.ListenPacket("udp", ds.PacketConn.LocalAddr().String())
+			if err != nil {
+				t.Errorf("udp listener was not closed: %s", err)
+				continue
+			}
+			pc.Close()
+		} else {
+			ln, err := net.Listen("tcp", ds.Listener.Addr().String())
+			if err != nil {
+				t.Errorf("tcp listener was not closed: %s", err)
+				continue
+			}
+			ln.Close()
+		}
+	}
+}
+
+func TestServerReload(t *testing.T) {
+	defer setConfig(getConfig())
+	saved := NewBlockList()
+	saved.Replace(gBlockCache)
+	defer gBlockCache.Replace(saved)
+
+	dir, err := ioutil.TempDir("", "ghost-reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "dns.toml")
+	write := func(conf string) {
+		conf = fmt.Sprintf("datadir = %q\nsources = []\neasylists = []\n%s", dir, conf)
+		if err := ioutil.WriteFile(path, []byte(conf), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`bind = "127.0.0.1:53"
+blocklist = ["ads.example.com"]`)
+	if err := LoadConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(Listeners(), time.Second, time.Second)
+	defer s.handler.Close()
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if !gBlockCache.Exists("ads.example.com") {
+		t.Fatal("blocklist was not loaded")
+	}
+
+	write(`bind = "127.0.0.1:5353"
+blocklist = ["www.example.com"]
+fakeIPs = ["192.0.2.53"]
+[[routes]]
+domains = ["corp.example.com"]
+upstream = "ispnameservers"`)
+	old := getConfig()
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	if gBlockCache.Exists("ads.example.com") || !gBlockCache.Exists("www.example.com") {
+		t.Error("blocklist was not rebuilt")
+	}
+	if upstream, ok := s.handler.resolver.routes.Match("a.corp.example.com"); !ok || upstream != "ispnameservers" {
+		t.Error("routes were not rebuilt")
+	}
+	defer gFakeIPCache.Remove("192.0.2.53")
+	if !gFakeIPCache.Exists("192.0.2.53") || gFakeIPCache.Exists("93.46.8.89") {
+		t.Error("cold fake ips were not replaced")
+	}
+	if changed := restartRequired(old, getConfig()); !reflect.DeepEqual(changed, []string{"Bind"}) {
+		t.Errorf("expected Bind to need a restart, got %v", changed)
+	}
+
+	// an invalid config is rejected and the running one is kept
+	write(`[[routes]]
+upstream = "unknown"`)
+	cur := getConfig()
+	if err := s.Reload(); err == nil {
+		t.Error("invalid config should be rejected")
+	}
+	if getConfig() != cur {
+		t.Error("running config was replaced by an invalid one")
+	}
+}
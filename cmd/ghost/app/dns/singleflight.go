@@ -0,0 +1,51 @@
+package dns
+
+import (
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// call is an in-flight lookup
+type call struct {
+	wg   sync.WaitGroup
+	msg  *dns.Msg
+	err  error
+	dups int
+}
+
+// flightGroup coalesces concurrent lookups of the same key into one
+type flightGroup struct {
+	mu sync.Mutex
+	m  map[string]*call
+}
+
+// Do executes fn once for all concurrent callers with the same key, and
+// returns its result to each of them. shared reports whether the result was
+// given to more than one caller, in which case it must not be modified.
+func (g *flightGroup) Do(key string, fn func() (*dns.Msg, error)) (msg *dns.Msg, shared bool, err error) {
+	g.mu.Lock()
+	if g.m == nil {
+		g.m = make(map[string]*call)
+	}
+	if c, ok := g.m[key]; ok {
+		c.dups++
+		g.mu.Unlock()
+		c.wg.Wait()
+		return c.msg, true, c.err
+	}
+	c := new(call)
+	c.wg.Add(1)
+	g.m[key] = c
+	g.mu.Unlock()
+
+	c.msg, c.err = fn()
+	c.wg.Done()
+
+	g.mu.Lock()
+	delete(g.m, key)
+	shared = c.dups > 0
+	g.mu.Unlock()
+
+	return c.msg, shared, c.err
+}
@@ -0,0 +1,56 @@
+package dns
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestFlightGroup(t *testing.T) {
+	var g flightGroup
+	var calls int32
+	release := make(chan struct{})
+
+	fn := func() (*dns.Msg, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		m := new(dns.Msg)
+		m.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
+		return m, nil
+	}
+
+	const n = 10
+	var wg sync.WaitGroup
+	msgs := make([]*dns.Msg, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			msg, shared, err := g.Do(testDomain, fn)
+			if err != nil || !shared {
+				t.Errorf("expected shared result, got shared=%v err=%v", shared, err)
+			}
+			msgs[i] = msg
+		}(i)
+	}
+	// give every caller the chance to join the flight
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("expected 1 lookup, got %d", calls)
+	}
+	for _, msg := range msgs[1:] {
+		if msg != msgs[0] {
+			t.Error("callers got different results")
+		}
+	}
+
+	if _, shared, _ := g.Do(testDomain, fn); shared {
+		t.Error("finished flight should not be shared")
+	}
+}
@@ -0,0 +1,100 @@
+package dns
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// upstream exchanges messages with one nameserver
+type upstream interface {
+	// Exchange sends req and waits for the answer, net is "udp" or "tcp"
+	// and may be ignored by transports which have their own
+	Exchange(net string, req *dns.Msg) (*dns.Msg, time.Duration, error)
+	// Close releases the connections kept for later exchanges
+	Close()
+}
+
+// plainUpstream is a nameserver at host:port, queried over udp or tcp
+type plainUpstream struct {
+	addr    string
+	timeout time.Duration
+}
+
+// Exchange implements upstream
+func (u *plainUpstream) Exchange(net string, req *dns.Msg) (*dns.Msg, time.Duration, error) {
+	c := &dns.Client{
+		Net:          net,
+		ReadTimeout:  u.timeout,
+		WriteTimeout: u.timeout,
+	}
+	return c.Exchange(req, u.addr)
+}
+
+// Close implements upstream, plain dns keeps no connection
+func (u *plainUpstream) Close() {}
+
+// newUpstream parses a nameserver address, which is host:port for plain dns,
+// https://host/path for DNS over HTTPS or tls://host:port for DNS over TLS
+func newUpstream(addr string, timeout time.Duration) (upstream, error) {
+	if strings.HasPrefix(addr, "https://") {
+		return newDoHUpstream(addr, timeout)
+	}
+	if strings.HasPrefix(addr, "tls://") {
+		return newDoTUpstream(addr, timeout)
+	}
+
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, errors.Wrapf(err, "invalid nameserver: %s", addr)
+	}
+	return &plainUpstream{addr, timeout}, nil
+}
+
+// upstreamPool keeps one upstream per nameserver address, so that
+// connections can be reused between lookups
+type upstreamPool struct {
+	mu        sync.Mutex
+	upstreams map[string]upstream
+}
+
+// Get returns the upstream of nameserver
+func (p *upstreamPool) Get(nameserver string) (upstream, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if u, ok := p.upstreams[nameserver]; ok {
+		return u, nil
+	}
+	u, err := newUpstream(nameserver, getConfig().Timeout.Duration)
+	if err != nil {
+		return nil, err
+	}
+	if p.upstreams == nil {
+		p.upstreams = make(map[string]upstream)
+	}
+	p.upstreams[nameserver] = u
+	return u, nil
+}
+
+// Prune closes and removes the upstreams of nameservers which are not in
+// nameservers, after a reload dropped them
+func (p *upstreamPool) Prune(nameservers []string) {
+	keep := make(map[string]bool)
+	for _, ns := range nameservers {
+		keep[ns] = true
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for ns, u := range p.upstreams {
+		if !keep[ns] {
+			u.Close()
+			delete(p.upstreams, ns)
+		}
+	}
+}